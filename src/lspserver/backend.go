@@ -1,13 +1,78 @@
 package lspserver
 
+import (
+	"context"
+	"encoding/json"
+)
+
 var ParamBackend *string
 var ParamPromptFile *string
 var ParamConnectTest *bool
 var ParamRetryPromptFile *string
+var ParamRuleCatalog *string
+
+// Constrain the backend output to findingsSchema, see Settings.StructuredOutput
+var ParamStructuredOutput *bool
+
+// Analyse the workspace files in the background, see Settings.WorkspaceAnalysis
+var ParamWorkspaceAnalysis *bool
+var ParamWorkspaceMaxFiles *int
+
+// Socket address, e.g. "tcp:127.0.0.1:7998", empty to serve a single client over stdio
+var ParamListen *string
+
+// Only set from the config file, see RuleDocs
+var ParamRuleDocs map[string]string
+
+// Only set from the config file, see Settings.Backends
+var ParamBackends map[string]json.RawMessage
+
+// Only set from the config file, see Settings.ContextWindows
+var ParamContextWindows map[string]int
+
+// Only set from the config file, see Settings.Routes
+var ParamRoutes []Route
+
 /* Backend agnostic methods */
 type LspBackend interface {
 	Start() error
-	AnalyseDocument(string, string) (string, error)
-	// CompleteCode(string, string) ([]string, error)
-	CompleteCode(string, string, string) ([]string, error)
+	// AnalyseDocument returns the raw model output for a document, see DiagnosticsUnmarshal
+	AnalyseDocument(ctx context.Context, req *AnalysisRequest) (*AnalysisResponse, error)
+	// CompleteCode fills in the code between a prefix and a suffix, see CompletionQuery
+	CompleteCode(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error)
+	// Cancel aborts any request in flight
+	Cancel()
+}
+
+/*
+ * AnalysisRequest asks a backend to analyse one document. Backends must stop as soon as the
+ * context passed along is done, it is cancelled by $/cancelRequest and by llmlint.cancelAll.
+ */
+type AnalysisRequest struct {
+	URI      string
+	Document string
+	// Sent ahead of the document when a previous answer could not be parsed, empty otherwise
+	RetryPrompt string
+	// Reports how many requests of the analysis are done, may be nil
+	Progress ProgressFunc
+	// Receives the findings while they are streamed, may be nil. Backends that cannot stream
+	// report nothing, the findings are in the response all the same.
+	Findings FindingFunc
+}
+
+type AnalysisResponse struct {
+	// The model output, all chunks concatenated
+	Analysis string
+}
+
+// CompletionRequest asks a backend to fill in the code at the cursor
+type CompletionRequest struct {
+	URI    string
+	Prefix string
+	Suffix string
+}
+
+type CompletionResponse struct {
+	// Alternatives, best first
+	Completions []string
 }
@@ -0,0 +1,365 @@
+package lspserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// Error bodies are cut to this length before they end up in an error message
+const maxErrorBodyLength = 512
+
+/*
+ * CompatConfig is the "openai-compatible" section of the backends setting. It points the backend
+ * at any server speaking the OpenAI chat completions API, e.g. llama.cpp server or vLLM. Like
+ * every backend section it is only read from the config file, never from the clients.
+ */
+type CompatConfig struct {
+	// Base URL of the API, /chat/completions is appended, e.g. "http://localhost:8080/v1"
+	BaseURL string `json:"base_url"`
+	// Model sent with every request, the model setting takes precedence
+	Model string `json:"model,omitempty"`
+	// Extra headers sent with every request
+	Headers map[string]string `json:"headers,omitempty"`
+	// Environment variable holding the API key, sent as bearer token
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// File holding the API key, used when APIKeyEnv is not set
+	APIKeyFile string `json:"api_key_file,omitempty"`
+	MaxTokens  int    `json:"max_tokens,omitempty"`
+	Seed       *int   `json:"seed,omitempty"`
+	// Requests sent at once, defaultParallelRequests when unset
+	ParallelRequests int `json:"parallel_requests,omitempty"`
+}
+
+func init() {
+	RegisterBackend("openai-compatible", "any OpenAI compatible chat API, e.g. llama.cpp or vLLM", NewCompatBackend)
+}
+
+/* backend specific private data */
+type lspBackendCompat struct {
+	// Analyses of a document run one at a time, their chunks in parallel
+	documents        documentLocks
+	limiter          *requestLimiter
+	httpClient       *http.Client
+	config           CompatConfig
+	apiKey           string
+	modelName        string
+	modelSeed        int
+	modelMaxTokens   int
+	contextWindow    int
+	modelTemperature float64
+	systemPromptFile string
+	systemPrompt     string
+	rules            []string
+	// Ask for findingsSchema, turned off when the server rejects it
+	structured atomic.Bool
+	cancels    cancelGroup
+}
+
+type compatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type compatRequest struct {
+	Model       string          `json:"model,omitempty"`
+	Messages    []compatMessage `json:"messages"`
+	Temperature float64         `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Seed        int             `json:"seed"`
+	Stream      bool            `json:"stream,omitempty"`
+	// Only set in structured output mode
+	ResponseFormat *compatResponseFormat `json:"response_format,omitempty"`
+}
+
+type compatResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *compatJSONSchema `json:"json_schema,omitempty"`
+}
+
+type compatJSONSchema struct {
+	Name   string          `json:"name"`
+	Strict bool            `json:"strict"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+// compatFindingsFormat asks for output following findingsSchema
+var compatFindingsFormat = &compatResponseFormat{
+	Type:       "json_schema",
+	JSONSchema: &compatJSONSchema{Name: "findings", Strict: true, Schema: findingsSchema},
+}
+
+type compatResponse struct {
+	Choices []struct {
+		Message compatMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// compatStreamChunk is one server-sent event of a streamed chat completion
+type compatStreamChunk struct {
+	Choices []struct {
+		Delta compatMessage `json:"delta"`
+	} `json:"choices"`
+}
+
+func NewCompatBackend(settings Settings, config CompatConfig) (LspBackend, error) {
+	if config.BaseURL == "" {
+		return nil, errors.New("openai-compatible backend needs a base_url")
+	}
+	b := &lspBackendCompat{
+		limiter:          newRequestLimiter(config.ParallelRequests),
+		httpClient:       newRetryClient(newBackendRetrier("openai-compatible backend")),
+		config:           config,
+		modelName:        config.Model,
+		modelMaxTokens:   4096,
+		modelTemperature: math.SmallestNonzeroFloat64,
+		modelSeed:        42,
+		systemPromptFile: settings.PromptFile,
+		rules:            settings.Rules,
+	}
+	b.structured.Store(settings.structuredOutput())
+	if settings.Model != "" {
+		b.modelName = settings.Model
+	}
+	if settings.Temperature != nil {
+		b.modelTemperature = *settings.Temperature
+	}
+	if config.MaxTokens > 0 {
+		b.modelMaxTokens = config.MaxTokens
+	}
+	if config.Seed != nil {
+		b.modelSeed = *config.Seed
+	}
+	b.contextWindow = settings.contextWindow(b.modelName)
+	return b, nil
+}
+
+func (b *lspBackendCompat) Start() error {
+	logs.Printf("OpenAI compatible LSP Backend starting, base URL %s", b.config.BaseURL)
+
+	apiKey, err := b.loadAPIKey()
+	if err != nil {
+		return err
+	}
+	b.apiKey = apiKey
+
+	systemPrompt, err := LoadPrompt(b.systemPromptFile)
+	if err != nil {
+		return err
+	}
+	b.systemPrompt = string(systemPrompt) + RulesPrompt(b.rules)
+	return nil
+}
+
+// loadAPIKey reads the API key from the configured source, servers without authentication need none
+func (b *lspBackendCompat) loadAPIKey() (string, error) {
+	switch {
+	case b.config.APIKeyEnv != "":
+		key := os.Getenv(b.config.APIKeyEnv)
+		if key == "" {
+			return "", fmt.Errorf("%s not set", b.config.APIKeyEnv)
+		}
+		return key, nil
+	case b.config.APIKeyFile != "":
+		key, err := os.ReadFile(b.config.APIKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("reading API key: %w", err)
+		}
+		return strings.TrimSpace(string(key)), nil
+	default:
+		return "", nil
+	}
+}
+
+// requestContext returns the context of the next request, cancelled by ctx and by Cancel. The
+// returned func releases the context once the request is done.
+func (b *lspBackendCompat) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return b.cancels.context(ctx)
+}
+
+// Cancel aborts the requests currently in flight, if any
+func (b *lspBackendCompat) Cancel() {
+	b.cancels.cancel()
+}
+
+func (b *lspBackendCompat) AnalyseDocument(ctx context.Context, req *AnalysisRequest) (*AnalysisResponse, error) {
+	logs.Printf("Analyse Document: %s", req.URI)
+
+	unlock := b.documents.lock(req.URI)
+	defer unlock()
+
+	ctx, done := b.requestContext(ctx)
+	defer done()
+
+	chunks := preprocessDocument2(req.Document, chunkTokenBudget(b.contextWindow, b.systemPrompt, req, b.modelMaxTokens))
+	logs.Printf("Preprocessed Document into %d chunks", len(chunks))
+
+	findings := serializeFindings(req.Findings)
+	responses, err := runParallel(ctx, b.limiter, len(chunks),
+		func(ctx context.Context, i int) (string, error) {
+			query := chunkQuery(req, i, chunks[i])
+			response, err := b.request(ctx, b.systemPrompt, query, findings, b.structured.Load())
+			if errors.Is(err, errStructuredOutputUnsupported) {
+				if b.structured.CompareAndSwap(true, false) {
+					logs.Printf("%v, falling back to prompt only mode", err)
+				}
+				response, err = b.request(ctx, b.systemPrompt, query, findings, false)
+			}
+			return response, err
+		},
+		func(i int, completed int, response string) {
+			logs.Printf("[+] Response for chunk %d: %s", i+1, response)
+			req.Progress.Report(completed, len(chunks), fmt.Sprintf("chunk %d/%d", completed, len(chunks)))
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var responseBuilder strings.Builder
+	for _, response := range responses {
+		responseBuilder.WriteString(response)
+		responseBuilder.WriteString("\n")
+	}
+	return &AnalysisResponse{Analysis: responseBuilder.String()}, nil
+}
+
+func (b *lspBackendCompat) CompleteCode(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error) {
+	ctx, done := b.requestContext(ctx)
+	defer done()
+
+	if err := b.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer b.limiter.release()
+
+	response, err := b.request(ctx, CompletionSystemPrompt, CompletionQuery(req.Prefix, req.Suffix), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return &CompletionResponse{Completions: ParseCompletions(response, req.Prefix, req.Suffix)}, nil
+}
+
+// request sends one chat completion and returns the content of the first choice. The answer is
+// streamed when findings are wanted and follows findingsSchema when structured is set.
+func (b *lspBackendCompat) request(ctx context.Context, systemPrompt string, query string, findings FindingFunc, structured bool) (string, error) {
+	var format *compatResponseFormat
+	if structured {
+		format = compatFindingsFormat
+	}
+	body, err := json.Marshal(compatRequest{
+		Model: b.modelName,
+		Messages: []compatMessage{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: query},
+		},
+		Temperature:    b.modelTemperature,
+		MaxTokens:      b.modelMaxTokens,
+		Seed:           b.modelSeed,
+		Stream:         findings != nil,
+		ResponseFormat: format,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimSuffix(b.config.BaseURL, "/") + "/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+	for name, value := range b.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readCompatStream(resp.Body, newFindingScanner(findings))
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(data))
+		if len(message) > maxErrorBodyLength {
+			message = message[:maxErrorBodyLength] + "..."
+		}
+		if structured && schemaRejected(resp.StatusCode, message) {
+			return "", fmt.Errorf("%w: %s: %s: %s", errStructuredOutputUnsupported, url, resp.Status, message)
+		}
+		return "", fmt.Errorf("%s: %s: %s", url, resp.Status, message)
+	}
+
+	var completion compatResponse
+	if err = json.Unmarshal(data, &completion); err != nil {
+		return "", fmt.Errorf("invalid chat completion: %w", err)
+	}
+	if len(completion.Choices) == 0 {
+		return "", errors.New("chat completion without choices")
+	}
+
+	content := completion.Choices[0].Message.Content
+	logs.Printf("%s", content)
+	// Servers ignoring the stream flag answer in one piece
+	if findings != nil {
+		newFindingScanner(findings).Write(content)
+	}
+	return content, nil
+}
+
+// readCompatStream collects the content of a streamed chat completion, every delta is fed to
+// the scanner as it arrives
+func readCompatStream(body io.Reader, scanner *findingScanner) (string, error) {
+	var content strings.Builder
+	lines := bufio.NewScanner(body)
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lines.Scan() {
+		data, ok := strings.CutPrefix(lines.Text(), "data:")
+		if !ok {
+			// Blank separators, comments and other event fields
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk compatStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("invalid chat completion chunk: %w", err)
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		scanner.Write(delta)
+	}
+	if err := lines.Err(); err != nil {
+		return "", err
+	}
+
+	logs.Printf("%s", content.String())
+	return content.String(), nil
+}
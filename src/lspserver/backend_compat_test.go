@@ -0,0 +1,302 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCompatServer answers chat completions with content and records the last request
+func newCompatServer(t *testing.T, content string, last *http.Request, lastBody *compatRequest) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*last = *r
+		if err := json.NewDecoder(r.Body).Decode(lastBody); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{
+				map[string]interface{}{"message": map[string]string{"role": "assistant", "content": content}},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCompatBackendAnalyseDocument(t *testing.T) {
+	var last http.Request
+	var body compatRequest
+	server := newCompatServer(t, "[]", &last, &body)
+
+	t.Setenv("COMPAT_TEST_KEY", "secret")
+	settings := Settings{PromptFile: writeFile(t, "prompt.txt", "You are a linter."), Rules: []string{"No goto"}}
+	backend, err := NewCompatBackend(settings, CompatConfig{
+		BaseURL:   server.URL + "/v1/",
+		Model:     "qwen2.5-coder",
+		Headers:   map[string]string{"X-Team": "firmware"},
+		APIKeyEnv: "COMPAT_TEST_KEY",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := backend.AnalyseDocument(context.Background(), &AnalysisRequest{
+		URI:      "file:///x.c",
+		Document: "int main(void)\n{\n    return 0;\n}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(response.Analysis) != "[]" {
+		t.Errorf("response = %q, want []", response)
+	}
+
+	if got := last.Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+	if got := last.Header.Get("X-Team"); got != "firmware" {
+		t.Errorf("X-Team = %q", got)
+	}
+	if body.Model != "qwen2.5-coder" {
+		t.Errorf("model = %q", body.Model)
+	}
+	if len(body.Messages) != 2 || !strings.Contains(body.Messages[0].Content, "No goto") ||
+		!strings.Contains(body.Messages[1].Content, "Line 3:     return 0;") {
+		t.Errorf("unexpected messages %+v", body.Messages)
+	}
+}
+
+func TestCompatBackendSettingsModelAndKeyFile(t *testing.T) {
+	var last http.Request
+	var body compatRequest
+	server := newCompatServer(t, "```c\nreturn 0;\n```", &last, &body)
+
+	settings := Settings{PromptFile: writeFile(t, "prompt.txt", "prompt"), Model: "override"}
+	backend, err := NewCompatBackend(settings, CompatConfig{
+		BaseURL:    server.URL + "/v1",
+		Model:      "configured",
+		APIKeyFile: writeFile(t, "key", "from-file\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := backend.CompleteCode(context.Background(), &CompletionRequest{
+		URI:    "file:///x.c",
+		Prefix: "int f(void)\n{\n    ",
+		Suffix: "\n}\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Completions) != 1 || response.Completions[0] != "return 0;" {
+		t.Errorf("completions = %q", response.Completions)
+	}
+	if body.Model != "override" {
+		t.Errorf("model = %q, want the model setting", body.Model)
+	}
+	if got := last.Header.Get("Authorization"); got != "Bearer from-file" {
+		t.Errorf("Authorization = %q", got)
+	}
+}
+
+func TestCompatBackendErrors(t *testing.T) {
+	if _, err := NewCompatBackend(Settings{}, CompatConfig{}); err == nil {
+		t.Error("missing base_url accepted")
+	}
+
+	backend, _ := NewCompatBackend(Settings{}, CompatConfig{BaseURL: "http://localhost", APIKeyEnv: "COMPAT_TEST_UNSET"})
+	if err := backend.Start(); err == nil || !strings.Contains(err.Error(), "COMPAT_TEST_UNSET") {
+		t.Errorf("Start() = %v, want missing key error", err)
+	}
+
+	var last http.Request
+	var body compatRequest
+	server := newCompatServer(t, "", &last, &body)
+	backend, _ = NewCompatBackend(Settings{PromptFile: writeFile(t, "prompt.txt", "prompt")}, CompatConfig{BaseURL: server.URL})
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := backend.AnalyseDocument(context.Background(), &AnalysisRequest{URI: "file:///x.c", Document: "int x;\n"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("AnalyseDocument() = %v, want 404 error", err)
+	}
+}
+
+func TestCompatBackendStream(t *testing.T) {
+	// The second finding has braces and an escaped quote in its strings, the stream splits both
+	content := "```json\n[{\"line_number\": 1, \"rule\": \"Rule 15.1\", \"description\": \"goto\"},\n" +
+		" {\"line_number\": 2, \"rule\": \"Rule 17.7\", \"description\": \"use {x} \\\" ok\"}]\n```"
+	var body compatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < len(content); i += 5 {
+			delta, _ := json.Marshal(content[i:min(i+5, len(content))])
+			fmt.Fprintf(w, "data: {\"choices\": [{\"delta\": {\"content\": %s}}]}\n\n", delta)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	backend, _ := NewCompatBackend(Settings{PromptFile: writeFile(t, "prompt.txt", "prompt")}, CompatConfig{BaseURL: server.URL})
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var findings []LspDiagnostic
+	response, err := backend.AnalyseDocument(context.Background(), &AnalysisRequest{
+		URI:      "file:///x.c",
+		Document: "goto out;\nf();\n",
+		Findings: func(finding LspDiagnostic) { findings = append(findings, finding) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !body.Stream {
+		t.Error("request not streamed")
+	}
+	if strings.TrimSpace(response.Analysis) != content {
+		t.Errorf("analysis = %q", response.Analysis)
+	}
+	if len(findings) != 2 || findings[0].Rule != "Rule 15.1" || findings[1].Description != `use {x} " ok` {
+		t.Errorf("findings = %+v", findings)
+	}
+}
+
+func TestCompatBackendStructuredOutput(t *testing.T) {
+	var formats []*compatResponseFormat
+	rejectFormat := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body compatRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		formats = append(formats, body.ResponseFormat)
+		if body.ResponseFormat != nil && rejectFormat {
+			http.Error(w, `{"error": "response_format is not supported"}`, http.StatusBadRequest)
+			return
+		}
+		content := `{"findings": []}`
+		if body.ResponseFormat == nil {
+			content = "[]"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": map[string]string{"content": content}}},
+		})
+	}))
+	defer server.Close()
+
+	settings := Settings{PromptFile: writeFile(t, "prompt.txt", "prompt")}
+	backend, _ := NewCompatBackend(settings, CompatConfig{BaseURL: server.URL})
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+	request := &AnalysisRequest{URI: "file:///x.c", Document: "int x;\n"}
+	response, err := backend.AnalyseDocument(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(formats) != 1 || formats[0] == nil || formats[0].JSONSchema.Name != "findings" {
+		t.Fatalf("response_format not sent: %+v", formats)
+	}
+	// No findings is a valid answer, not one to retry
+	if diagnostics, err := DiagnosticsUnmarshal("file:///x.c", response.Analysis); err != nil || len(diagnostics) != 0 {
+		t.Errorf("DiagnosticsUnmarshal(%q) = %v, %v", response.Analysis, diagnostics, err)
+	}
+
+	// Rejected once, the backend sticks to the prompt
+	formats, rejectFormat = nil, true
+	if _, err = backend.AnalyseDocument(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = backend.AnalyseDocument(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if len(formats) != 3 || formats[0] == nil || formats[1] != nil || formats[2] != nil {
+		t.Errorf("formats after rejection: %+v", formats)
+	}
+
+	disabled := false
+	settings.StructuredOutput = &disabled
+	formats = nil
+	backend, _ = NewCompatBackend(settings, CompatConfig{BaseURL: server.URL})
+	backend.Start()
+	backend.AnalyseDocument(context.Background(), request)
+	if len(formats) != 1 || formats[0] != nil {
+		t.Errorf("response_format sent with structured output disabled")
+	}
+}
+
+func TestCompatBackendCancel(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The connection is only watched for the client going away once the body was read
+		io.Copy(io.Discard, r.Body)
+		close(started)
+		// Only returns once the client gave up on the request
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	backend, _ := NewCompatBackend(Settings{PromptFile: writeFile(t, "prompt.txt", "prompt")}, CompatConfig{BaseURL: server.URL})
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := backend.AnalyseDocument(ctx, &AnalysisRequest{URI: "file:///x.c", Document: "int x;\n"})
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("AnalyseDocument() = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the context did not abort the HTTP request")
+	}
+}
+
+func TestCompatBackendRegistered(t *testing.T) {
+	raw := json.RawMessage(`{"base_url": "http://localhost:8080/v1", "model": "m"}`)
+	backend, err := newBackend(Settings{Backend: "openai-compatible", Backends: map[string]json.RawMessage{"openai-compatible": raw}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := backend.(*lspBackendCompat); b.config.BaseURL != "http://localhost:8080/v1" || b.modelName != "m" {
+		t.Errorf("config not applied: %+v", b.config)
+	}
+}
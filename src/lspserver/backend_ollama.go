@@ -1,13 +1,18 @@
 package lspserver
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
-	"sync"
+	"sync/atomic"
 
 	"github.com/TobiasYin/go-lsp/logs"
 	"github.com/tmc/langchaingo/llms"
@@ -17,27 +22,73 @@ import (
 
 /* backend specific private data */
 type lspBackendOllama struct {
-	mutex            sync.Mutex
+	// Analyses of a document run one at a time, their chunks in parallel
+	documents      documentLocks
+	limiter        *requestLimiter
 	client           *ollama.Chat
 	connected        bool
 	modelName        string
 	modelSeed        int
 	modelMaxTokens   int
+	// Tokens of the model context, sent as num_ctx since Ollama defaults to 2048
+	contextWindow    int
 	modelTemperature float64
 	systemPromptFile string
 	systemPrompt     string
-	cancel           context.CancelFunc
+	rules            []string
+	serverURL        string
+	// The client builds its own transport, calls are retried as a whole
+	retrier *backendRetrier
+	// The client cannot send a format, structured analyses are posted to /api/chat directly
+	httpClient *http.Client
+	structured atomic.Bool
+	cancels    cancelGroup
 }
 
-func NewOllamaBackend() LspBackend {
-	return &lspBackendOllama{
-		mutex:            sync.Mutex{},
+// OllamaConfig is the "ollama" section of the backends setting
+type OllamaConfig struct {
+	// Ollama server, the client default http://localhost:11434 when empty
+	ServerURL string `json:"server_url,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+	Seed      *int   `json:"seed,omitempty"`
+	// Requests sent at once, defaultParallelRequests when unset. Ollama itself serves
+	// OLLAMA_NUM_PARALLEL of them at a time and queues the rest.
+	ParallelRequests int `json:"parallel_requests,omitempty"`
+}
+
+func init() {
+	RegisterBackend("ollama", "local models served by Ollama", NewOllamaBackend)
+}
+
+func NewOllamaBackend(settings Settings, config OllamaConfig) (LspBackend, error) {
+	b := &lspBackendOllama{
+		limiter:          newRequestLimiter(config.ParallelRequests),
 		connected:        false,
 		modelName:        "deepseek-coder",
 		modelMaxTokens:   4096,
 		modelTemperature: math.SmallestNonzeroFloat64,
 		modelSeed:        42,
+		systemPromptFile: settings.PromptFile,
+		rules:            settings.Rules,
+		serverURL:        config.ServerURL,
+	}
+	b.structured.Store(settings.structuredOutput())
+	b.retrier = newBackendRetrier("Ollama backend")
+	b.httpClient = newRetryClient(b.retrier)
+	if settings.Model != "" {
+		b.modelName = settings.Model
 	}
+	if settings.Temperature != nil {
+		b.modelTemperature = *settings.Temperature
+	}
+	if config.MaxTokens > 0 {
+		b.modelMaxTokens = config.MaxTokens
+	}
+	if config.Seed != nil {
+		b.modelSeed = *config.Seed
+	}
+	b.contextWindow = settings.contextWindow(b.modelName)
+	return b, nil
 }
 
 func (b *lspBackendOllama) Start() error {
@@ -56,58 +107,203 @@ func (b *lspBackendOllama) connect() error {
 	var err error
 	var systemPrompt []byte
 
-	b.client, err = ollama.NewChat(ollama.WithLLMOptions(ollama.WithModel(b.modelName)))
+	options := []ollama.Option{ollama.WithModel(b.modelName), ollama.WithRunnerNumCtx(b.contextWindow)}
+	if b.serverURL != "" {
+		options = append(options, ollama.WithServerURL(b.serverURL))
+	}
+	b.client, err = ollama.NewChat(ollama.WithLLMOptions(options...))
 	logs.Printf("Ollama New Chat....\n")
 	if err != nil {
 		return err
 	}
 
-	systemPrompt, err = LoadPrompt(*ParamPromptFile)
+	systemPrompt, err = LoadPrompt(b.systemPromptFile)
 	logs.Printf("Prompts Loaded....\n%s", systemPrompt)
 	if err != nil {
 		return err
 	}
 
-	b.systemPromptFile = *ParamPromptFile
-	b.systemPrompt = string(systemPrompt)
+	b.systemPrompt = string(systemPrompt) + RulesPrompt(b.rules)
 
 	return nil
 }
 
-func (b *lspBackendOllama) request(ctx context.Context, query string) (string, error) {
+// requestContext returns the context of the next request, cancelled by ctx and by Cancel. The
+// returned func releases the context once the request is done.
+func (b *lspBackendOllama) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return b.cancels.context(ctx)
+}
+
+// Cancel aborts the requests currently in flight, if any
+func (b *lspBackendOllama) Cancel() {
+	b.cancels.cancel()
+}
+
+// request sends one query, streaming the answer into findings when they are wanted
+func (b *lspBackendOllama) request(ctx context.Context, query string, findings FindingFunc) (string, error) {
 	logs.Printf("System Prompt: %s\nQuery: %s\n", b.systemPrompt, query)
-	completion, err := b.client.Call(ctx, []schema.ChatMessage{
-		schema.SystemChatMessage{Content: b.systemPrompt},
-		schema.HumanChatMessage{Content: query},
-	},
+	if b.structured.Load() {
+		content, err := b.structuredRequest(ctx, query, findings)
+		if !errors.Is(err, errStructuredOutputUnsupported) {
+			return content, err
+		}
+		if b.structured.CompareAndSwap(true, false) {
+			logs.Printf("%v, falling back to prompt only mode", err)
+		}
+	}
+	options := []llms.CallOption{
 		llms.WithTemperature(b.modelTemperature),
 		llms.WithModel(b.modelName),
 		llms.WithMaxTokens(b.modelMaxTokens),
 		llms.WithSeed(b.modelSeed),
-	)
+	}
+	streamed := false
+	if findings != nil {
+		scanner := newFindingScanner(findings)
+		options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			streamed = true
+			scanner.Write(string(chunk))
+			return nil
+		}))
+	}
 
+	var completion *schema.AIChatMessage
+	err := b.retrier.do(ctx, func() (err error) {
+		completion, err = b.client.Call(ctx, []schema.ChatMessage{
+			schema.SystemChatMessage{Content: b.systemPrompt},
+			schema.HumanChatMessage{Content: query},
+		}, options...)
+		if err != nil && streamed {
+			// Repeating it would report the findings streamed so far again
+			return &finalError{err}
+		}
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 
-	logs.Printf(completion.Content)
+	logs.Printf("%s", completion.Content)
 	return completion.Content, nil
 }
 
-// preprocessDocument splits the document into chunks of 50 lines each with correct line numbers
-func preprocessDocument(document string) []string {
-	var lines []string
-	retryPrompt, err := os.ReadFile(*ParamRetryPromptFile)
+// ollamaMessage, ollamaChatRequest and ollamaChatResponse are the parts of the /api/chat API
+// structured analyses use
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaChatRequest struct {
+	Model    string                 `json:"model"`
+	Messages []ollamaMessage        `json:"messages"`
+	Stream   bool                   `json:"stream"`
+	Format   json.RawMessage        `json:"format"`
+	Options  map[string]interface{} `json:"options"`
+}
+
+type ollamaChatResponse struct {
+	Message *ollamaMessage `json:"message"`
+	Done    bool           `json:"done"`
+	Error   string         `json:"error"`
+}
+
+// ollamaBaseURL returns the server the client talks to, the same default as the client
+func (b *lspBackendOllama) ollamaBaseURL() string {
+	if b.serverURL != "" {
+		return strings.TrimSuffix(b.serverURL, "/")
+	}
+	if host := os.Getenv("OLLAMA_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return strings.TrimSuffix(host, "/")
+	}
+	return "http://127.0.0.1:11434"
+}
+
+/*
+ * structuredRequest sends one analysis query with findingsSchema as format, Ollama then only
+ * samples output following the schema. Servers predating schema formats reject the request,
+ * which is reported as errStructuredOutputUnsupported.
+ *
+ * @param ctx The context of the request
+ * @param query The chunk query
+ * @param findings Receives the findings while they are streamed, may be nil
+ * @return content The answer, a JSON object following findingsSchema
+ * @return error Any error that occurred during the request
+ */
+func (b *lspBackendOllama) structuredRequest(ctx context.Context, query string, findings FindingFunc) (string, error) {
+	body, err := json.Marshal(ollamaChatRequest{
+		Model: b.modelName,
+		Messages: []ollamaMessage{
+			{Role: "system", Content: b.systemPrompt},
+			{Role: "user", Content: query},
+		},
+		Stream: findings != nil,
+		Format: findingsSchema,
+		Options: map[string]interface{}{
+			"temperature": b.modelTemperature,
+			"num_predict": b.modelMaxTokens,
+			"num_ctx":     b.contextWindow,
+			"seed":        b.modelSeed,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	url := b.ollamaBaseURL() + "/api/chat"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.httpClient.Do(req)
 	if err != nil {
-		logs.Printf("Unable to read the retry prompt file")
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLength))
+		message := strings.TrimSpace(string(data))
+		if schemaRejected(resp.StatusCode, message) {
+			return "", fmt.Errorf("%w: %s: %s: %s", errStructuredOutputUnsupported, url, resp.Status, message)
+		}
+		return "", fmt.Errorf("%s: %s: %s", url, resp.Status, message)
 	}
 
-	// Check if the document starts with the retry prompt
-	if strings.HasPrefix(document, string(retryPrompt)) {
-		// Remove the retry prompt from the start of the document
-		document = strings.TrimPrefix(document, string(retryPrompt))
+	// Streamed answers are one JSON object per line, others a single one
+	var content strings.Builder
+	scanner := newFindingScanner(findings)
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var chunk ollamaChatResponse
+		if err = decoder.Decode(&chunk); err != nil {
+			return "", err
+		}
+		if chunk.Error != "" {
+			return "", errors.New(chunk.Error)
+		}
+		if chunk.Message != nil {
+			content.WriteString(chunk.Message.Content)
+			scanner.Write(chunk.Message.Content)
+		}
+		if chunk.Done {
+			break
+		}
 	}
 
+	logs.Printf("%s", content.String())
+	return content.String(), nil
+}
+
+// preprocessDocument splits the document into chunks along function and statement boundaries with correct line numbers
+func preprocessDocument(document string, maxTokens int) []sourceChunk {
+	var lines []string
+
 	// Determine the newline character based on the OS
 	switch runtime.GOOS {
 	case "windows":
@@ -118,113 +314,81 @@ func preprocessDocument(document string) []string {
 		lines = strings.Split(document, "\n")
 	}
 
-	chunkSize := 30
-	var chunks []string
-	for i := 0; i < len(lines); i += chunkSize {
-		end := i + chunkSize
-		if end > len(lines) {
-			end = len(lines)
-		}
-		var chunk strings.Builder
-		for j := i; j < end; j++ {
-			chunk.WriteString(fmt.Sprintf("Line %d: %s\n", j+1, lines[j]))
-		}
-		chunks = append(chunks, chunk.String())
-	}
-
-	return chunks
+	return chunkDocument(lines, maxTokens)
 }
 
-func (b *lspBackendOllama) AnalyseDocument(uri string, document string) (string, error) {
-	logs.Printf("Analyse Document: %s\n%s", uri, document)
+func (b *lspBackendOllama) AnalyseDocument(ctx context.Context, req *AnalysisRequest) (*AnalysisResponse, error) {
+	logs.Printf("Analyse Document: %s\n%s", req.URI, req.Document)
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	// Cancel any previous request
-	if b.cancel != nil {
-		b.cancel()
-	}
+	unlock := b.documents.lock(req.URI)
+	defer unlock()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
+	ctx, done := b.requestContext(ctx)
+	defer done()
 
-	logs.Printf("Document Input: %s", document)
-
-	chunks := preprocessDocument(document)
+	chunks := preprocessDocument(req.Document, chunkTokenBudget(b.contextWindow, b.systemPrompt, req, b.modelMaxTokens))
 	logs.Printf("Preprocessed Document into %d chunks", len(chunks))
 
-	var err error
-	PrevMod := b.modelName
-	if strings.HasSuffix(uri, ".py") {
-		b.modelName = "deepseek-coder"
-	} else {
-		b.modelName = "deepseek-coder"
-	}
-
-	if PrevMod != b.modelName {
-		b.client, err = ollama.NewChat(ollama.WithLLMOptions(ollama.WithModel(b.modelName)))
-		logs.Printf("Ollama New Chat....\n")
-		if err != nil {
-			return "", err
-		}
+	findings := serializeFindings(req.Findings)
+	responses, err := runParallel(ctx, b.limiter, len(chunks),
+		func(ctx context.Context, i int) (string, error) {
+			return b.request(ctx, chunkQuery(req, i, chunks[i]), findings)
+		},
+		func(i int, completed int, response string) {
+			logs.Printf("[+] Response for chunk %d: %s", i+1, response)
+			req.Progress.Report(completed, len(chunks), fmt.Sprintf("chunk %d/%d", completed, len(chunks)))
+		})
+	if err != nil {
+		return nil, err
 	}
 
 	var responseBuilder strings.Builder
-	for i, chunk := range chunks {
-		query := fmt.Sprintf("FileName: %s\nSource Code (Chunk %d):\n%s", uri, i+1, chunk)
-		response, err := b.request(ctx, query)
-		if err != nil {
-			return "", err
-		}
+	for _, response := range responses {
 		responseBuilder.WriteString(response)
 		responseBuilder.WriteString("\n")
-		logs.Printf("[+] Response for chunk %d: %s", i+1, response)
 	}
-
-	return responseBuilder.String(), nil
+	return &AnalysisResponse{Analysis: responseBuilder.String()}, nil
 }
-// Implement CompleteCode method for code completion with custom systemPrompt
-func (b *lspBackendOllama) CompleteCode(uri string, prefix string, systemPrompt string) ([]string, error) {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
 
-	// Cancel any previous request
-	if b.cancel != nil {
-		b.cancel()
-	}
+// Implement CompleteCode method for fill-in-the-middle code completion
+func (b *lspBackendOllama) CompleteCode(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error) {
+	ctx, done := b.requestContext(ctx)
+	defer done()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
+	if err := b.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer b.limiter.release()
 
-	query := fmt.Sprintf("Complete the code following this prefix:\n%s<PROVIDE_SUGGESTION_HERE>", prefix)
-	response, err := b.requestWithPrompt(ctx, query, systemPrompt) // Use custom prompt
+	response, err := b.requestWithPrompt(ctx, CompletionQuery(req.Prefix, req.Suffix), CompletionSystemPrompt)
 	if err != nil {
 		return nil, err
 	}
 
-	// Split the response into possible completions
-	completions := strings.Split(response, "\n")
-	return completions, nil
+	return &CompletionResponse{Completions: ParseCompletions(response, req.Prefix, req.Suffix)}, nil
 }
 
 // Updated request method to allow custom system prompts
 func (b *lspBackendOllama) requestWithPrompt(ctx context.Context, query string, systemPrompt string) (string, error) {
 	logs.Printf("Completion System Prompt: %s\nQuery: %s\n", systemPrompt, query)
-	completion, err := b.client.Call(ctx, []schema.ChatMessage{
-		schema.SystemChatMessage{Content: systemPrompt},
-		schema.HumanChatMessage{Content: query},
-	},
-		llms.WithTemperature(b.modelTemperature),
-		llms.WithModel(b.modelName),
-		llms.WithMaxTokens(b.modelMaxTokens),
-		llms.WithSeed(b.modelSeed),
-	)
+	var completion *schema.AIChatMessage
+	err := b.retrier.do(ctx, func() (err error) {
+		completion, err = b.client.Call(ctx, []schema.ChatMessage{
+			schema.SystemChatMessage{Content: systemPrompt},
+			schema.HumanChatMessage{Content: query},
+		},
+			llms.WithTemperature(b.modelTemperature),
+			llms.WithModel(b.modelName),
+			llms.WithMaxTokens(b.modelMaxTokens),
+			llms.WithSeed(b.modelSeed),
+		)
+		return err
+	})
 
 	if err != nil {
 		return "", err
 	}
 
-	logs.Printf(completion.Content)
+	logs.Printf("%s", completion.Content)
 	return completion.Content, nil
 }
@@ -0,0 +1,94 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newOllamaServer answers /api/chat with content, servers with rejectSchema refuse schema formats
+func newOllamaServer(t *testing.T, content string, rejectSchema bool, formats *[]json.RawMessage) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Format json.RawMessage `json:"format"`
+			Stream *bool           `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		*formats = append(*formats, body.Format)
+		if rejectSchema && len(body.Format) > 0 && body.Format[0] == '{' {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "json: cannot unmarshal object into Go struct field ChatRequest.format of type string"}`))
+			return
+		}
+		// One line per token when streamed, the way Ollama does
+		if body.Stream != nil && *body.Stream {
+			for _, r := range content {
+				json.NewEncoder(w).Encode(map[string]interface{}{"message": map[string]string{"role": "assistant", "content": string(r)}})
+			}
+		} else {
+			json.NewEncoder(w).Encode(map[string]interface{}{"message": map[string]string{"role": "assistant", "content": content}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": map[string]string{"role": "assistant"}, "done": true})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOllamaBackendStructuredOutput(t *testing.T) {
+	content := `{"findings": [{"line_number": 1, "rule": "Rule 8.4", "severity": "required", "description": "no prototype"}]}`
+	var formats []json.RawMessage
+	server := newOllamaServer(t, content, false, &formats)
+
+	backend, _ := NewOllamaBackend(Settings{PromptFile: writeFile(t, "prompt.txt", "prompt")}, OllamaConfig{ServerURL: server.URL})
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var streamed []LspDiagnostic
+	response, err := backend.AnalyseDocument(context.Background(), &AnalysisRequest{
+		URI:      "file:///x.c",
+		Document: "int f() { return 0; }\n",
+		Findings: func(finding LspDiagnostic) { streamed = append(streamed, finding) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]interface{}
+	if len(formats) != 1 || json.Unmarshal(formats[0], &schema) != nil || schema["type"] != "object" {
+		t.Fatalf("format = %s, want findingsSchema", formats)
+	}
+	if len(streamed) != 1 || streamed[0].Rule != "Rule 8.4" {
+		t.Errorf("streamed findings = %+v", streamed)
+	}
+	diagnostics, err := DiagnosticsUnmarshal("file:///x.c", response.Analysis)
+	if err != nil || len(diagnostics) != 1 || diagnostics[0].Uri != "file:///x.c" {
+		t.Errorf("DiagnosticsUnmarshal() = %+v, %v", diagnostics, err)
+	}
+}
+
+func TestOllamaBackendStructuredOutputFallback(t *testing.T) {
+	var formats []json.RawMessage
+	server := newOllamaServer(t, `[{"line_number": 1, "rule": "Rule 8.4"}]`, true, &formats)
+
+	backend, _ := NewOllamaBackend(Settings{PromptFile: writeFile(t, "prompt.txt", "prompt")}, OllamaConfig{ServerURL: server.URL})
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+	request := &AnalysisRequest{URI: "file:///x.c", Document: "int f() { return 0; }\n"}
+	for i := 0; i < 2; i++ {
+		response, err := backend.AnalyseDocument(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diagnostics, err := DiagnosticsUnmarshal("file:///x.c", response.Analysis); err != nil || len(diagnostics) != 1 {
+			t.Errorf("DiagnosticsUnmarshal() = %+v, %v", diagnostics, err)
+		}
+	}
+	// The schema is only tried once, the prompt only requests send no format
+	if len(formats) != 3 || formats[0][0] != '{' || formats[1][0] == '{' || formats[2][0] == '{' {
+		t.Errorf("formats = %s", formats)
+	}
+}
@@ -7,7 +7,7 @@ import (
 	"math"
 	"os"
 	"strings"
-	"sync"
+	"sync/atomic"
 
 	"github.com/TobiasYin/go-lsp/logs"
 	"github.com/tmc/langchaingo/llms"
@@ -17,15 +17,27 @@ import (
 
 /* backend specific private data */
 type lspBackendOpenAi struct {
-	mutex            sync.Mutex
+	// Analyses of a document run one at a time, their requests in parallel
+	documents        documentLocks
+	limiter          *requestLimiter
 	client           *openai.Chat
 	connected        bool
 	modelName        string
 	modelSeed        int
 	modelMaxTokens   int
+	contextWindow    int
 	modelTemperature float64
 	systemPromptFile string
 	systemPrompt     string
+	rules            []string
+	baseURL          string
+	// Ask for findingsSchema, turned off when the server rejects it
+	structured atomic.Bool
+	// Sends the structured output requests, the client cannot set a response_format
+	structuredClient *lspBackendCompat
+	// Rules evaluated together by one request, see batchRules
+	ruleBatches [][]int
+	cancels     cancelGroup
 }
 
 var misraRules = []string{
@@ -60,15 +72,64 @@ var misraRules = []string{
 	"Define bitfield widths for `BOOL`, enums, and flags to ensure proper alignment.",
 }
 
-func NewOpenAiBackend() LspBackend {
-	return &lspBackendOpenAi{
-		mutex:            sync.Mutex{},
+// OpenAiConfig is the "openai" section of the backends setting
+type OpenAiConfig struct {
+	// API endpoint, the client default https://api.openai.com/v1 when empty
+	BaseURL   string `json:"base_url,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+	Seed      *int   `json:"seed,omitempty"`
+	// Estimated tokens of the rules sent with one request, defaultRuleBatchTokens when unset.
+	// Small budgets send fewer rules per request, at least one.
+	RuleBatchTokens int `json:"rule_batch_tokens,omitempty"`
+	// Requests sent at once, defaultParallelRequests when unset
+	ParallelRequests int `json:"parallel_requests,omitempty"`
+}
+
+// defaultOpenAiBaseURL is the API endpoint of the structured output requests without a base_url
+const defaultOpenAiBaseURL = "https://api.openai.com/v1"
+
+// defaultRuleBatchTokens fits the default rules into a single request
+const defaultRuleBatchTokens = 1024
+
+func init() {
+	RegisterBackend("openai", "OpenAI chat models, needs OPENAI_API_KEY", NewOpenAiBackend)
+}
+
+func NewOpenAiBackend(settings Settings, config OpenAiConfig) (LspBackend, error) {
+	b := &lspBackendOpenAi{
+		limiter:          newRequestLimiter(config.ParallelRequests),
 		connected:        false,
 		modelName:        "gpt-4-1106-preview",
 		modelMaxTokens:   4096,
 		modelTemperature: math.SmallestNonzeroFloat64,
 		modelSeed:        42,
+		systemPromptFile: settings.PromptFile,
+		rules:            misraRules,
+		baseURL:          config.BaseURL,
+	}
+	b.structured.Store(settings.structuredOutput())
+	if settings.Model != "" {
+		b.modelName = settings.Model
 	}
+	if settings.Temperature != nil {
+		b.modelTemperature = *settings.Temperature
+	}
+	if len(settings.Rules) != 0 {
+		b.rules = settings.Rules
+	}
+	if config.MaxTokens > 0 {
+		b.modelMaxTokens = config.MaxTokens
+	}
+	if config.Seed != nil {
+		b.modelSeed = *config.Seed
+	}
+	b.contextWindow = settings.contextWindow(b.modelName)
+	budget := defaultRuleBatchTokens
+	if config.RuleBatchTokens > 0 {
+		budget = config.RuleBatchTokens
+	}
+	b.ruleBatches = batchRules(b.rules, budget)
+	return b, nil
 }
 
 func (b *lspBackendOpenAi) Start() error {
@@ -91,20 +152,41 @@ func (b *lspBackendOpenAi) connect() error {
 		return errors.New("OPENAI_API_KEY not set")
 	}
 
-	b.client, err = openai.NewChat(openai.WithModel(b.modelName))
+	httpClient := newRetryClient(newBackendRetrier("OpenAI backend"))
+	options := []openai.Option{
+		openai.WithModel(b.modelName),
+		openai.WithHTTPClient(httpClient),
+	}
+	if b.baseURL != "" {
+		options = append(options, openai.WithBaseURL(b.baseURL))
+	}
+	b.client, err = openai.NewChat(options...)
 	if err != nil {
 		return err
 	}
 
-	systemPrompt, err = LoadPrompt(*ParamPromptFile)
+	baseURL := b.baseURL
+	if baseURL == "" {
+		baseURL = defaultOpenAiBaseURL
+	}
+	b.structuredClient = &lspBackendCompat{
+		httpClient:       httpClient,
+		config:           CompatConfig{BaseURL: baseURL},
+		apiKey:           os.Getenv("OPENAI_API_KEY"),
+		modelName:        b.modelName,
+		modelSeed:        b.modelSeed,
+		modelMaxTokens:   b.modelMaxTokens,
+		modelTemperature: b.modelTemperature,
+	}
+
+	systemPrompt, err = LoadPrompt(b.systemPromptFile)
 	if err != nil {
 		return err
 	}
 
-	b.systemPromptFile = *ParamPromptFile
 	b.systemPrompt = string(systemPrompt)
 	if *ParamConnectTest {
-		response, err := b.request("int main() { return 0; }", "")
+		response, err := b.request(context.Background(), "int main() { return 0; }", batchPrompt(b.rules, []int{0}), nil)
 		if err != nil {
 			return err
 		}
@@ -113,111 +195,148 @@ func (b *lspBackendOpenAi) connect() error {
 	return nil
 }
 
-func (b *lspBackendOpenAi) request(query string, rule string) (string, error) {
-	ctx := context.Background()
+// requestContext returns the context of the next request, cancelled by ctx and by Cancel. The
+// returned func releases the context once the request is done.
+func (b *lspBackendOpenAi) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return b.cancels.context(ctx)
+}
 
-	prompt := fmt.Sprintf("%s\nRule: %s", b.systemPrompt, rule)
+// Cancel aborts the requests currently in flight, if any
+func (b *lspBackendOpenAi) Cancel() {
+	b.cancels.cancel()
+}
 
-	completion, err := b.client.Call(ctx, []schema.ChatMessage{
-		schema.SystemChatMessage{Content: prompt},
-		schema.HumanChatMessage{Content: query},
-	},
+// request checks query against a batch of rules, streaming the answer into findings when they are wanted.
+// In structured output mode the answer follows findingsSchema, servers rejecting the
+// response_format get the prompt only from then on.
+func (b *lspBackendOpenAi) request(ctx context.Context, query string, rules string, findings FindingFunc) (string, error) {
+	prompt := b.systemPrompt + rules
+	if b.structured.Load() {
+		response, err := b.structuredClient.request(ctx, prompt, query, findings, true)
+		if !errors.Is(err, errStructuredOutputUnsupported) {
+			return response, err
+		}
+		if b.structured.CompareAndSwap(true, false) {
+			logs.Printf("%v, falling back to prompt only mode", err)
+		}
+	}
+
+	options := []llms.CallOption{
 		llms.WithTemperature(b.modelTemperature),
 		llms.WithModel(b.modelName),
 		llms.WithMaxTokens(b.modelMaxTokens),
 		llms.WithSeed(b.modelSeed),
-	)
+	}
+	if findings != nil {
+		scanner := newFindingScanner(findings)
+		options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			scanner.Write(string(chunk))
+			return nil
+		}))
+	}
+	completion, err := b.client.Call(ctx, []schema.ChatMessage{
+		schema.SystemChatMessage{Content: prompt},
+		schema.HumanChatMessage{Content: query},
+	}, options...)
 
 	if err != nil {
 		return "", err
 	}
 
-	logs.Printf(completion.Content)
+	logs.Printf("%s", completion.Content)
 	return completion.Content, nil
 }
 
-// preprocessDocument2 splits the document into chunks of 30 lines each with correct line numbers
-func preprocessDocument2(document string) []string {
+// preprocessDocument2 splits the document into chunks along function and statement boundaries with correct line numbers
+func preprocessDocument2(document string, maxTokens int) []sourceChunk {
 	var lines []string
-	retryPrompt, err := os.ReadFile(*ParamRetryPromptFile)
-	if err != nil {
-		logs.Printf("Unable to read the retry prompt file")
-	}
-	// Check if the document starts with the retry prompt
-	if strings.HasPrefix(document, string(retryPrompt)) {
-		// Remove the retry prompt from the start of the document
-		document = strings.TrimPrefix(document, string(retryPrompt))
-	}
 
 	// Split the document into lines
 	lines = strings.Split(document, "\n")
 
-	chunkSize := 30
-	var chunks []string
-	for i := 0; i < len(lines); i += chunkSize {
-		end := i + chunkSize
-		if end > len(lines) {
-			end = len(lines)
-		}
-		var chunk strings.Builder
-		for j := i; j < end; j++ {
-			chunk.WriteString(fmt.Sprintf("Line %d: %s\n", j+1, lines[j]))
-		}
-		chunks = append(chunks, chunk.String())
-	}
-
-	return chunks
+	return chunkDocument(lines, maxTokens)
 }
 
-func (b *lspBackendOpenAi) AnalyseDocument(uri string, document string) (string, error) {
-	logs.Printf("AnalyseDocument: %s", document)
-
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+func (b *lspBackendOpenAi) AnalyseDocument(ctx context.Context, req *AnalysisRequest) (*AnalysisResponse, error) {
+	logs.Printf("AnalyseDocument: %s", req.Document)
 
-	logs.Printf("Document Input: %s", document)
+	unlock := b.documents.lock(req.URI)
+	defer unlock()
 
-	chunks := preprocessDocument2(document)
-	logs.Printf("Preprocessed Document into %d chunks", len(chunks))
+	ctx, done := b.requestContext(ctx)
+	defer done()
 
-	var responseBuilder strings.Builder
-	for _, rule := range misraRules {
-		for i, chunk := range chunks {
-			query := fmt.Sprintf("FileName: %s\nSource Code (Chunk %d):\n%s", uri, i+1, chunk)
-			response, err := b.request(query, rule)
+	// Chunks have to fit next to the largest batch of rules
+	prompt := ""
+	for _, batch := range b.ruleBatches {
+		if rules := batchPrompt(b.rules, batch); len(rules) > len(prompt) {
+			prompt = rules
+		}
+	}
+	chunks := preprocessDocument2(req.Document,
+		chunkTokenBudget(b.contextWindow, b.systemPrompt+prompt, req, b.modelMaxTokens))
+	logs.Printf("Preprocessed Document into %d chunks, %d rule batches", len(chunks), len(b.ruleBatches))
+
+	findings := serializeFindings(req.Findings)
+	// Request j checks chunk j % len(chunks) against rule batch j / len(chunks)
+	total := len(b.ruleBatches) * len(chunks)
+	responses, err := runParallel(ctx, b.limiter, total,
+		func(ctx context.Context, j int) (string, error) {
+			batch, i := b.ruleBatches[j/len(chunks)], j%len(chunks)
+			var batchFindings FindingFunc
+			if findings != nil {
+				batchFindings = func(finding LspDiagnostic) {
+					attributeFinding(&finding, b.rules, batch)
+					findings(finding)
+				}
+			}
+			response, err := b.request(ctx, chunkQuery(req, i, chunks[i]), batchPrompt(b.rules, batch), batchFindings)
 			if err != nil {
 				return "", err
 			}
-			responseBuilder.WriteString(response)
-			responseBuilder.WriteString("\n")
-			logs.Printf("[+] Response for chunk %d with rule %s: %s", i+1, rule, response)
-		}
+			return attributeFindings(response, b.rules, batch), nil
+		},
+		func(j int, completed int, response string) {
+			r, i := j/len(chunks), j%len(chunks)
+			logs.Printf("[+] Response for chunk %d with rules %d/%d: %s", i+1, r+1, len(b.ruleBatches), response)
+			req.Progress.Report(completed, total, fmt.Sprintf("request %d/%d", completed, total))
+		})
+	if err != nil {
+		return nil, err
 	}
 
-	return responseBuilder.String(), nil
+	var responseBuilder strings.Builder
+	for _, response := range responses {
+		responseBuilder.WriteString(response)
+		responseBuilder.WriteString("\n")
+	}
+	return &AnalysisResponse{Analysis: responseBuilder.String()}, nil
 }
 
 // OnCompletion processes the completion request
-func (b *lspBackendOpenAi) CompleteCode(uri string, query string, systemPrompt string) ([]string, error) {
-	logs.Printf("OnCompletion: %s", query)
+func (b *lspBackendOpenAi) CompleteCode(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error) {
+	logs.Printf("OnCompletion: %s", req.URI)
+
+	ctx, done := b.requestContext(ctx)
+	defer done()
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	if err := b.limiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer b.limiter.release()
 
-	response, err := b.requestWithPrompt(query, systemPrompt)
+	response, err := b.requestWithPrompt(ctx, CompletionQuery(req.Prefix, req.Suffix), CompletionSystemPrompt)
 	if err != nil {
 		return nil, err
 	}
 
 	logs.Printf("[+] Completion Response: %s", response)
-	completions := strings.Split(response, "\n")
-	return completions, nil
+	return &CompletionResponse{Completions: ParseCompletions(response, req.Prefix, req.Suffix)}, nil
 }
 
-func (b *lspBackendOpenAi) requestWithPrompt(query string, systemPrompt string) (string, error) {
-	ctx := context.Background()
+func (b *lspBackendOpenAi) requestWithPrompt(ctx context.Context, query string, systemPrompt string) (string, error) {
 	logs.Printf("Completion System Prompt: %s\nQuery: %s\n", systemPrompt, query)
-	
+
 	completion, err := b.client.Call(ctx, []schema.ChatMessage{
 		schema.SystemChatMessage{Content: systemPrompt},
 		schema.HumanChatMessage{Content: query},
@@ -231,6 +350,6 @@ func (b *lspBackendOpenAi) requestWithPrompt(query string, systemPrompt string)
 		return "", err
 	}
 
-	logs.Printf(completion.Content)
+	logs.Printf("%s", completion.Content)
 	return completion.Content, nil
 }
\ No newline at end of file
@@ -0,0 +1,75 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAiBackendStructuredOutput(t *testing.T) {
+	var formats []*compatResponseFormat
+	rejectFormat := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body compatRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		formats = append(formats, body.ResponseFormat)
+		if body.ResponseFormat != nil && rejectFormat {
+			http.Error(w, `{"error": "response_format is not supported"}`, http.StatusBadRequest)
+			return
+		}
+		content := `{"findings": [{"line_number": 1, "end_line_number": null, "column": null, "snippet": null,
+			"source": "int x;", "rule": "Rule 8.4", "severity": "required", "description": "d", "recommendation": "r"}]}`
+		if body.ResponseFormat == nil {
+			content = "[]"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": map[string]string{"role": "assistant", "content": content}}},
+		})
+	}))
+	defer server.Close()
+
+	connectTest := false
+	ParamConnectTest = &connectTest
+	defer func() { ParamConnectTest = nil }()
+	t.Setenv("OPENAI_API_KEY", "secret")
+	settings := Settings{PromptFile: writeFile(t, "prompt.txt", "prompt"), Rules: []string{"Rule 8.4"}}
+	backend, _ := NewOpenAiBackend(settings, OpenAiConfig{BaseURL: server.URL})
+	if err := backend.Start(); err != nil {
+		t.Fatal(err)
+	}
+	request := &AnalysisRequest{URI: "file:///x.c", Document: "int x;\n"}
+	response, err := backend.AnalyseDocument(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(formats) != 1 || formats[0] == nil || !formats[0].JSONSchema.Strict || formats[0].JSONSchema.Name != "findings" {
+		t.Fatalf("response_format not sent: %+v", formats)
+	}
+	if diagnostics, err := DiagnosticsUnmarshal("file:///x.c", response.Analysis); err != nil || len(diagnostics) != 1 {
+		t.Errorf("DiagnosticsUnmarshal(%q) = %v, %v", response.Analysis, diagnostics, err)
+	}
+
+	// Rejected once, the backend sticks to the prompt
+	formats, rejectFormat = nil, true
+	if _, err = backend.AnalyseDocument(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = backend.AnalyseDocument(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if len(formats) != 3 || formats[0] == nil || formats[1] != nil || formats[2] != nil {
+		t.Errorf("formats after rejection: %+v", formats)
+	}
+
+	disabled := false
+	settings.StructuredOutput = &disabled
+	formats = nil
+	backend, _ = NewOpenAiBackend(settings, OpenAiConfig{BaseURL: server.URL})
+	backend.Start()
+	backend.AnalyseDocument(context.Background(), request)
+	if len(formats) != 1 || formats[0] != nil {
+		t.Errorf("response_format sent with structured output disabled")
+	}
+}
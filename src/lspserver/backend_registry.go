@@ -0,0 +1,103 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ * BackendFactory creates a backend from the settings and the raw config section of the backend,
+ * the backend still has to be started. Register factories with RegisterBackend.
+ */
+type BackendFactory func(settings Settings, config json.RawMessage) (LspBackend, error)
+
+type registeredBackend struct {
+	description string
+	factory     BackendFactory
+}
+
+var backendRegistry = struct {
+	sync.RWMutex
+	backends map[string]registeredBackend
+}{backends: make(map[string]registeredBackend)}
+
+/*
+ * RegisterBackend makes a backend available under name, usually from the init function of the
+ * file implementing it. The section of the "backends" setting named like the backend is decoded
+ * into a C and handed to the factory, a missing section gives the zero value of C.
+ *
+ * @param name The name selected with --backend or the backend setting
+ * @param description One line shown by --backend list
+ * @param factory Creates the backend from the settings and its typed config section
+ */
+func RegisterBackend[C any](name string, description string, factory func(settings Settings, config C) (LspBackend, error)) {
+	backendRegistry.Lock()
+	defer backendRegistry.Unlock()
+
+	if _, ok := backendRegistry.backends[name]; ok {
+		panic(fmt.Sprintf("backend %s registered twice", name))
+	}
+	backendRegistry.backends[name] = registeredBackend{
+		description: description,
+		factory: func(settings Settings, raw json.RawMessage) (LspBackend, error) {
+			var config C
+			if len(raw) != 0 && string(raw) != "null" {
+				if err := json.Unmarshal(raw, &config); err != nil {
+					return nil, fmt.Errorf("invalid %s backend config: %w", name, err)
+				}
+			}
+			return factory(settings, config)
+		},
+	}
+}
+
+// BackendNames returns the names of all registered backends in alphabetical order
+func BackendNames() []string {
+	backendRegistry.RLock()
+	defer backendRegistry.RUnlock()
+	return backendNames()
+}
+
+// BackendList describes every registered backend, one per line, for --backend list
+func BackendList() string {
+	backendRegistry.RLock()
+	defer backendRegistry.RUnlock()
+
+	names := backendNames()
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+
+	var list strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&list, "%-*s  %s\n", width, name, backendRegistry.backends[name].description)
+	}
+	return list.String()
+}
+
+// backendNames expects the caller to hold the registry lock
+func backendNames() []string {
+	names := make([]string, 0, len(backendRegistry.backends))
+	for name := range backendRegistry.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newBackend creates the backend selected by settings, it still has to be started.
+func newBackend(settings Settings) (LspBackend, error) {
+	backendRegistry.RLock()
+	backend, ok := backendRegistry.backends[settings.Backend]
+	backendRegistry.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("invalid backend: %s, valid backends: %s",
+			settings.Backend, strings.Join(BackendNames(), ", "))
+	}
+	return backend.factory(settings, settings.Backends[settings.Backend])
+}
@@ -0,0 +1,35 @@
+package lspserver
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBackendList(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(BackendList(), "\n"), "\n")
+	names := BackendNames()
+	if len(lines) != len(names) {
+		t.Fatalf("%d lines for %d backends:\n%s", len(lines), len(names), strings.Join(lines, "\n"))
+	}
+	if !sort.StringsAreSorted(lines) {
+		t.Errorf("backends not in alphabetical order:\n%s", strings.Join(lines, "\n"))
+	}
+
+	// The descriptions line up after the longest name, openai-compatible
+	listed := map[string]bool{}
+	for _, line := range lines {
+		listed[line] = true
+	}
+	for _, want := range []string{
+		"ollama             local models served by Ollama",
+		"openai             OpenAI chat models, needs OPENAI_API_KEY",
+		"openai-compatible  any OpenAI compatible chat API, e.g. llama.cpp or vLLM",
+		"record             records the responses of another backend into a cassette",
+		"replay             answers from a cassette recorded with the record backend",
+	} {
+		if !listed[want] {
+			t.Errorf("%q not listed:\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
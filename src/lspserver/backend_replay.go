@@ -0,0 +1,279 @@
+package lspserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// Kinds of cassette entries
+const (
+	cassetteAnalyse  = "analyse"
+	cassetteComplete = "complete"
+)
+
+/*
+ * cassetteEntry is one line of a cassette, a JSONL file of backend responses. Entries are found
+ * by Key, the hash of the system prompt and the query, the other fields keep the cassette
+ * readable. The document URI is not part of the key, so cassettes work on any checkout.
+ */
+type cassetteEntry struct {
+	Key         string   `json:"key"`
+	Kind        string   `json:"kind"`
+	URI         string   `json:"uri,omitempty"`
+	Query       string   `json:"query"`
+	Response    string   `json:"response,omitempty"`
+	Completions []string `json:"completions,omitempty"`
+}
+
+// ReplayConfig is the "replay" section of the backends setting, like RecordConfig it is only read
+// from the config file so clients cannot point the server at other files
+type ReplayConfig struct {
+	// Cassette written by the record backend
+	Cassette string `json:"cassette"`
+}
+
+// RecordConfig is the "record" section of the backends setting
+type RecordConfig struct {
+	// The backend whose responses are recorded, configured by its own section
+	Backend string `json:"backend"`
+	// Cassette the responses are appended to
+	Cassette string `json:"cassette"`
+}
+
+func init() {
+	RegisterBackend("replay", "answers from a cassette recorded with the record backend", NewReplayBackend)
+	RegisterBackend("record", "records the responses of another backend into a cassette", NewRecordBackend)
+}
+
+// cassetteKey identifies a request by its system prompt and query
+func cassetteKey(prompt string, query string) string {
+	hash := sha256.New()
+	io.WriteString(hash, prompt)
+	hash.Write([]byte{0})
+	io.WriteString(hash, query)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// analysisPrompt returns the system prompt an analysis is recorded under
+func analysisPrompt(settings Settings) (string, error) {
+	if settings.PromptFile == "" {
+		return RulesPrompt(settings.Rules), nil
+	}
+	prompt, err := LoadPrompt(settings.PromptFile)
+	if err != nil {
+		return "", err
+	}
+	return string(prompt) + RulesPrompt(settings.Rules), nil
+}
+
+// analysisQuery is the query an analysis is recorded under
+func analysisQuery(req *AnalysisRequest) string {
+	return req.RetryPrompt + req.Document
+}
+
+/* backend specific private data */
+type lspBackendReplay struct {
+	settings Settings
+	config   ReplayConfig
+	prompt   string
+	entries  map[string]cassetteEntry
+}
+
+func NewReplayBackend(settings Settings, config ReplayConfig) (LspBackend, error) {
+	if config.Cassette == "" {
+		return nil, errors.New("replay backend needs a cassette")
+	}
+	return &lspBackendReplay{settings: settings, config: config}, nil
+}
+
+func (b *lspBackendReplay) Start() error {
+	logs.Printf("Replay LSP Backend starting, cassette %s", b.config.Cassette)
+
+	prompt, err := analysisPrompt(b.settings)
+	if err != nil {
+		return err
+	}
+	b.prompt = prompt
+
+	file, err := os.Open(b.config.Cassette)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	b.entries = make(map[string]cassetteEntry)
+	// Recorded documents easily exceed the default line length of bufio.Scanner
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry cassetteEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("%s:%d: %w", b.config.Cassette, line, err)
+		}
+		// Later recordings of the same request win
+		b.entries[entry.Key] = entry
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	logs.Printf("[+] Replaying %d recorded responses", len(b.entries))
+	return nil
+}
+
+func (b *lspBackendReplay) AnalyseDocument(ctx context.Context, req *AnalysisRequest) (*AnalysisResponse, error) {
+	key := cassetteKey(b.prompt, analysisQuery(req))
+	entry, ok := b.entries[key]
+	if !ok || entry.Kind != cassetteAnalyse {
+		return nil, fmt.Errorf("no recorded analysis of %s in %s (key %s)", req.URI, b.config.Cassette, key)
+	}
+	// Streamed the way it was recorded, clients see the same findings either way
+	if req.Findings != nil {
+		newFindingScanner(req.Findings).Write(entry.Response)
+	}
+	req.Progress.Report(1, 1, "replayed")
+	return &AnalysisResponse{Analysis: entry.Response}, nil
+}
+
+func (b *lspBackendReplay) CompleteCode(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error) {
+	key := cassetteKey(CompletionSystemPrompt, CompletionQuery(req.Prefix, req.Suffix))
+	entry, ok := b.entries[key]
+	if !ok || entry.Kind != cassetteComplete {
+		return nil, fmt.Errorf("no recorded completion for %s in %s (key %s)", req.URI, b.config.Cassette, key)
+	}
+	return &CompletionResponse{Completions: entry.Completions}, nil
+}
+
+// Cancel has nothing to abort, replayed responses are immediate
+func (b *lspBackendReplay) Cancel() {}
+
+/*
+ * lspBackendRecord passes every request to another backend and appends the successful responses
+ * to a cassette, which the replay backend serves later on. Close closes the cassette.
+ */
+type lspBackendRecord struct {
+	backend LspBackend
+	config  RecordConfig
+	prompt  string
+	mutex   sync.Mutex
+	file    *os.File
+}
+
+func NewRecordBackend(settings Settings, config RecordConfig) (LspBackend, error) {
+	if config.Cassette == "" {
+		return nil, errors.New("record backend needs a cassette")
+	}
+	if config.Backend == "" || config.Backend == "record" {
+		return nil, fmt.Errorf("record backend cannot record %q", config.Backend)
+	}
+
+	prompt, err := analysisPrompt(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	settings.Backend = config.Backend
+	backend, err := newBackend(settings)
+	if err != nil {
+		return nil, err
+	}
+	return &lspBackendRecord{backend: backend, config: config, prompt: prompt}, nil
+}
+
+func (b *lspBackendRecord) Start() error {
+	logs.Printf("Recording %s backend into %s", b.config.Backend, b.config.Cassette)
+	if err := b.backend.Start(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(b.config.Cassette, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	b.file = file
+	return nil
+}
+
+func (b *lspBackendRecord) AnalyseDocument(ctx context.Context, req *AnalysisRequest) (*AnalysisResponse, error) {
+	response, err := b.backend.AnalyseDocument(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	query := analysisQuery(req)
+	b.record(cassetteEntry{
+		Key:      cassetteKey(b.prompt, query),
+		Kind:     cassetteAnalyse,
+		URI:      req.URI,
+		Query:    query,
+		Response: response.Analysis,
+	})
+	return response, nil
+}
+
+func (b *lspBackendRecord) CompleteCode(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error) {
+	response, err := b.backend.CompleteCode(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	query := CompletionQuery(req.Prefix, req.Suffix)
+	b.record(cassetteEntry{
+		Key:         cassetteKey(CompletionSystemPrompt, query),
+		Kind:        cassetteComplete,
+		URI:         req.URI,
+		Query:       query,
+		Completions: response.Completions,
+	})
+	return response, nil
+}
+
+func (b *lspBackendRecord) Cancel() {
+	b.backend.Cancel()
+}
+
+// record appends entry to the cassette right away, a failed write only costs the recording
+func (b *lspBackendRecord) record(entry cassetteEntry) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.file == nil {
+		logs.Printf("Not recording %s, the cassette is closed", entry.URI)
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = b.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		logs.Printf("Error recording %s: %v", entry.URI, err)
+	}
+}
+
+// Close closes the cassette, the recorded backend is closed too if it needs it
+func (b *lspBackendRecord) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var err error
+	if b.file != nil {
+		err = b.file.Close()
+		b.file = nil
+	}
+	if closer, ok := b.backend.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
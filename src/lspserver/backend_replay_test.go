@@ -0,0 +1,168 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubBackend answers every request with fixed responses and counts the calls
+type stubBackend struct {
+	analysis    string
+	completions []string
+	calls       int
+	cancels     int
+	// Called during every analysis when set, e.g. to edit the document meanwhile
+	analysing func()
+}
+
+type stubConfig struct {
+	Analysis string `json:"analysis"`
+}
+
+var stub = &stubBackend{}
+
+func init() {
+	RegisterBackend("test-stub", "fixed responses for tests", func(settings Settings, config stubConfig) (LspBackend, error) {
+		stub.analysis = config.Analysis
+		return stub, nil
+	})
+}
+
+func (b *stubBackend) Start() error { return nil }
+func (b *stubBackend) Cancel()      { b.cancels++ }
+
+func (b *stubBackend) AnalyseDocument(ctx context.Context, req *AnalysisRequest) (*AnalysisResponse, error) {
+	b.calls++
+	if b.analysing != nil {
+		b.analysing()
+	}
+	return &AnalysisResponse{Analysis: b.analysis}, nil
+}
+
+func (b *stubBackend) CompleteCode(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error) {
+	b.calls++
+	return &CompletionResponse{Completions: b.completions}, nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+	settings := Settings{
+		Backend:    "record",
+		PromptFile: writeFile(t, "prompt.txt", "You are a linter."),
+		Rules:      []string{"No goto"},
+		Backends: map[string]json.RawMessage{
+			"record":    json.RawMessage(`{"backend": "test-stub", "cassette": "` + cassette + `"}`),
+			"test-stub": json.RawMessage(`{"analysis": "[]"}`),
+		},
+	}
+	stub.completions = []string{"return 0;"}
+
+	recorder, err := newBackend(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = recorder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err = recorder.AnalyseDocument(ctx, &AnalysisRequest{URI: "file:///a/x.c", Document: "int x;\n"}); err != nil {
+		t.Fatal(err)
+	}
+	completion := &CompletionRequest{URI: "file:///a/x.c", Prefix: "int f(void) { ", Suffix: " }"}
+	if _, err = recorder.CompleteCode(ctx, completion); err != nil {
+		t.Fatal(err)
+	}
+	if err = recorder.(*lspBackendRecord).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 {
+		t.Fatalf("cassette has %d entries, want 2:\n%s", len(lines), data)
+	}
+
+	calls := stub.calls
+	settings.Backend = "replay"
+	settings.Backends["replay"] = json.RawMessage(`{"cassette": "` + cassette + `"}`)
+	replay, err := newBackend(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = replay.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The URI is not part of the key, cassettes replay on any checkout
+	analysis, err := replay.AnalyseDocument(ctx, &AnalysisRequest{URI: "file:///b/x.c", Document: "int x;\n"})
+	if err != nil || analysis.Analysis != "[]" {
+		t.Errorf("AnalyseDocument() = %+v, %v", analysis, err)
+	}
+	completion.URI = "file:///b/x.c"
+	completions, err := replay.CompleteCode(ctx, completion)
+	if err != nil || len(completions.Completions) != 1 || completions.Completions[0] != "return 0;" {
+		t.Errorf("CompleteCode() = %+v, %v", completions, err)
+	}
+	if stub.calls != calls {
+		t.Errorf("replay called the recorded backend")
+	}
+
+	if _, err = replay.AnalyseDocument(ctx, &AnalysisRequest{URI: "file:///b/x.c", Document: "int y;\n"}); err == nil {
+		t.Error("unrecorded document replayed")
+	}
+
+	// A different prompt is a different request
+	settings.Rules = []string{"No malloc"}
+	other, _ := newBackend(settings)
+	if err = other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.AnalyseDocument(ctx, &AnalysisRequest{URI: "file:///b/x.c", Document: "int x;\n"}); err == nil {
+		t.Error("analysis replayed for a different prompt")
+	}
+}
+
+func TestRecordRejectsItself(t *testing.T) {
+	if _, err := NewRecordBackend(Settings{}, RecordConfig{Backend: "record", Cassette: "x"}); err == nil {
+		t.Error("record backend recording itself")
+	}
+	if _, err := NewReplayBackend(Settings{}, ReplayConfig{}); err == nil {
+		t.Error("replay backend without cassette")
+	}
+}
+
+func TestClientCannotChooseCassette(t *testing.T) {
+	dir := t.TempDir()
+	configured, client := filepath.Join(dir, "configured.jsonl"), filepath.Join(dir, "client.jsonl")
+	backend := "test-stub"
+	ParamBackend = &backend
+	ParamBackends = map[string]json.RawMessage{"record": json.RawMessage(`{"backend": "test-stub", "cassette": "` + configured + `"}`)}
+	defer func() { ParamBackend, ParamBackends = nil, nil }()
+
+	l := NewLspServer("lsp-test").(*lspServer)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	err := l.applySettings(context.Background(), Settings{
+		Backend:  "record",
+		Backends: map[string]json.RawMessage{"record": json.RawMessage(`{"backend": "test-stub", "cassette": "` + client + `"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.backend.(io.Closer).Close()
+
+	if _, err = os.Stat(client); err == nil {
+		t.Errorf("client cassette %s created", client)
+	}
+	if settings := l.getSettings(); settings.Backend != "record" || string(settings.Backends["record"]) != string(ParamBackends["record"]) {
+		t.Errorf("settings %+v", settings)
+	}
+}
@@ -0,0 +1,114 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ruleIdPattern matches rule IDs as ruleId writes them, "Rule 17.7" of MISRA is none
+var ruleIdPattern = regexp.MustCompile(`(?i)^rule\s*(\d+)(?::|\s|$)`)
+
+// emptyAnswerPattern matches an answer without findings, fenced or not
+var emptyAnswerPattern = regexp.MustCompile("^\\s*(?:```(?:json)?\\s*)?\\[\\s*\\]\\s*(?:```)?\\s*$")
+
+// ruleId is the ID of rules[i] in prompts and findings, the numbering of RulesPrompt
+func ruleId(i int) string {
+	return fmt.Sprintf("Rule %d", i+1)
+}
+
+/*
+ * batchRules groups the rules evaluated by one request. Rules are taken in order until the next
+ * one would exceed the token budget, every batch holds at least one rule.
+ *
+ * @param rules The rules
+ * @param budget The estimated tokens of the rules of one batch
+ * @return batches The indices of the rules of each batch
+ */
+func batchRules(rules []string, budget int) [][]int {
+	var batches [][]int
+	var batch []int
+	tokens := 0
+	for i, rule := range rules {
+		cost := estimateTokens(fmt.Sprintf("- %s: %s\n", ruleId(i), rule))
+		if len(batch) > 0 && tokens+cost > budget {
+			batches = append(batches, batch)
+			batch, tokens = nil, 0
+		}
+		batch = append(batch, i)
+		tokens += cost
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// batchPrompt lists the rules of a batch for the system prompt, the model has to name them by ID
+func batchPrompt(rules []string, batch []int) string {
+	var b strings.Builder
+	b.WriteString("\nOnly evaluate the source code against the following rules:\n")
+	for _, i := range batch {
+		b.WriteString(fmt.Sprintf("- %s: %s\n", ruleId(i), rules[i]))
+	}
+	b.WriteString(fmt.Sprintf("Put the ID of the violated rule, e.g. \"%s\", in the \"rule\" field of every finding.\n",
+		ruleId(batch[0])))
+	return b.String()
+}
+
+/*
+ * attributeFinding makes the rule of a finding one of the IDs of its batch. Models also answer
+ * with the rule text or with "Rule 3: <text>", findings of single rule batches belong to that
+ * rule anyway. Other rules, e.g. the MISRA rule behind one of ours, are kept.
+ */
+func attributeFinding(finding *LspDiagnostic, rules []string, batch []int) {
+	rule := strings.TrimSpace(finding.Rule)
+	if match := ruleIdPattern.FindStringSubmatch(rule); match != nil {
+		n, _ := strconv.Atoi(match[1])
+		for _, i := range batch {
+			if i == n-1 {
+				finding.Rule = ruleId(i)
+				return
+			}
+		}
+	}
+	for _, i := range batch {
+		if strings.EqualFold(rule, strings.TrimSpace(rules[i])) {
+			finding.Rule = ruleId(i)
+			return
+		}
+	}
+	if len(batch) == 1 {
+		finding.Rule = ruleId(batch[0])
+	}
+}
+
+/*
+ * attributeFindings rewrites the answer to a batch with every finding attributed to its rule,
+ * see attributeFinding. The result is structured output, see findingsSchema, so answers without
+ * findings still parse. Unparsable answers are returned as they are for the retry.
+ *
+ * @param response The answer of the model
+ * @param rules The rules
+ * @param batch The indices of the rules the answer is about
+ * @return analysis The attributed findings
+ */
+func attributeFindings(response string, rules []string, batch []int) string {
+	findings, err := DiagnosticsUnmarshal("", response)
+	if err != nil {
+		if !emptyAnswerPattern.MatchString(response) {
+			return response
+		}
+		findings = []LspDiagnostic{}
+	}
+	for i := range findings {
+		attributeFinding(&findings[i], rules, batch)
+	}
+	data, err := json.Marshal(structuredAnalysis{Findings: &findings})
+	if err != nil {
+		return response
+	}
+	return string(data)
+}
@@ -0,0 +1,65 @@
+package lspserver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatchRules(t *testing.T) {
+	// Every rule line takes 7 tokens, "- Rule 1: abcdefghi\n"
+	rules := []string{"abcdefghi", "abcdefghi", "abcdefghi", "abcdefghi", "abcdefghi"}
+	for _, test := range []struct {
+		budget int
+		want   [][]int
+	}{
+		{1, [][]int{{0}, {1}, {2}, {3}, {4}}},
+		{14, [][]int{{0, 1}, {2, 3}, {4}}},
+		{20, [][]int{{0, 1}, {2, 3}, {4}}},
+		{1024, [][]int{{0, 1, 2, 3, 4}}},
+	} {
+		if got := batchRules(rules, test.budget); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("budget %d: %v, want %v", test.budget, got, test.want)
+		}
+	}
+	if got := batchRules(nil, 10); len(got) != 0 {
+		t.Errorf("no rules: %v", got)
+	}
+}
+
+func TestAttributeFindings(t *testing.T) {
+	rules := []string{"No goto", "No recursion", "No malloc", "Single exit"}
+	batch := []int{1, 2}
+
+	response := "```json\n[" +
+		`{"line_number": 1, "rule": "Rule 2: No recursion", "description": "a"},` +
+		`{"line_number": 2, "rule": "no malloc", "description": "b"},` +
+		`{"line_number": 3, "rule": "rule 3", "description": "c"},` +
+		`{"line_number": 4, "rule": "Rule 17.7", "description": "d"},` +
+		`{"line_number": 5, "rule": "Rule 1", "description": "e"}` +
+		"]\n```"
+	findings, ok := structuredFindings(attributeFindings(response, rules, batch))
+	if !ok {
+		t.Fatal("attributed answer is no structured output")
+	}
+	var got []string
+	for _, finding := range findings {
+		got = append(got, finding.Rule)
+	}
+	// Rule 1 is not in the batch, the model made it up, MISRA rules stay
+	want := []string{"Rule 2", "Rule 3", "Rule 3", "Rule 17.7", "Rule 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules %v, want %v", got, want)
+	}
+
+	single := attributeFindings(`[{"line_number": 1, "rule": "MISRA", "description": "a"}]`, rules, []int{3})
+	if findings, _ = structuredFindings(single); len(findings) != 1 || findings[0].Rule != "Rule 4" {
+		t.Errorf("single rule batch: %v", findings)
+	}
+
+	if findings, ok = structuredFindings(attributeFindings("```json\n[]\n```", rules, batch)); !ok || len(findings) != 0 {
+		t.Errorf("empty answer: %v, %v", findings, ok)
+	}
+	if garbage := "I cannot help with that"; attributeFindings(garbage, rules, batch) != garbage {
+		t.Error("unparsable answer was rewritten")
+	}
+}
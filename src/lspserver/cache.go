@@ -0,0 +1,75 @@
+package lspserver
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// analysisCacheSize bounds the number of analyses kept, the oldest is dropped first
+const analysisCacheSize = 256
+
+type cachedAnalysis struct {
+	analysis    string
+	diagnostics []LspDiagnostic
+}
+
+/*
+ * analysisCache is shared by every client session, so a document opened by several clients of a
+ * socket mode server is only analysed once. Entries are keyed by the document text, the cache
+ * has to be cleared whenever the settings change.
+ */
+type analysisCache struct {
+	mutex   sync.Mutex
+	entries map[[sha256.Size]byte]cachedAnalysis
+	order   [][sha256.Size]byte
+}
+
+func newAnalysisCache() *analysisCache {
+	return &analysisCache{entries: make(map[[sha256.Size]byte]cachedAnalysis)}
+}
+
+func (c *analysisCache) Load(text string) (cachedAnalysis, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[sha256.Sum256([]byte(text))]
+	return entry, ok
+}
+
+func (c *analysisCache) Store(text string, analysis string, diagnostics []LspDiagnostic) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := sha256.Sum256([]byte(text))
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = cachedAnalysis{analysis: analysis, diagnostics: diagnostics}
+
+	for len(c.order) > analysisCacheSize {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// Delete drops the analysis of text, the next analysis runs the backend again
+func (c *analysisCache) Delete(text string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := sha256.Sum256([]byte(text))
+	if _, ok := c.entries[key]; !ok {
+		return
+	}
+	delete(c.entries, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *analysisCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[[sha256.Size]byte]cachedAnalysis)
+	c.order = nil
+}
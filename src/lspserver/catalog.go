@@ -0,0 +1,84 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// maxExcerptLength bounds the catalog text shown in a hover, in bytes
+const maxExcerptLength = 300
+
+/*
+ * RuleCatalogEntry describes a single rule of a coding standard. The catalog file is a JSON
+ * array of entries, for example
+ *   [{"source": "MISRA C:2012", "rule": "Rule 17.7", "category": "Required",
+ *     "title": "The value returned by a function having non-void return type shall be used",
+ *     "text": "..."}]
+ */
+type RuleCatalogEntry struct {
+	Source   string `json:"source"`
+	Rule     string `json:"rule"`
+	Title    string `json:"title"`
+	Category string `json:"category,omitempty"`
+	Text     string `json:"text,omitempty"`
+}
+
+// RuleCatalog maps the source and rule of a finding to its catalog entry
+type RuleCatalog map[string]RuleCatalogEntry
+
+func ruleCatalogKey(source string, rule string) string {
+	return strings.ToLower(strings.Join(strings.Fields(source+" "+rule), " "))
+}
+
+/*
+ * LoadRuleCatalog reads a rule catalog file, an empty file name yields an empty catalog.
+ * @param fileName The path of the JSON catalog
+ * @return catalog The rules keyed by source and rule
+ * @return error Any error that occurred while reading or unmarshalling the file
+ */
+func LoadRuleCatalog(fileName string) (RuleCatalog, error) {
+	catalog := RuleCatalog{}
+	if fileName == "" {
+		return catalog, nil
+	}
+
+	data, err := LoadPrompt(fileName)
+	if err != nil {
+		return catalog, err
+	}
+
+	var entries []RuleCatalogEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return catalog, err
+	}
+	for _, e := range entries {
+		catalog[ruleCatalogKey(e.Source, e.Rule)] = e
+	}
+	return catalog, nil
+}
+
+// Lookup returns the entry of a rule, matching is case and whitespace insensitive
+func (c RuleCatalog) Lookup(source string, rule string) (RuleCatalogEntry, bool) {
+	e, ok := c[ruleCatalogKey(source, rule)]
+	return e, ok
+}
+
+// Excerpt returns the rule title followed by the start of its text, cut at a word boundary
+func (e RuleCatalogEntry) Excerpt() string {
+	excerpt := strings.TrimSpace(e.Title)
+	text := strings.Join(strings.Fields(e.Text), " ")
+	if text == "" {
+		return excerpt
+	}
+	if len(text) > maxExcerptLength {
+		cut := strings.LastIndex(text[:maxExcerptLength], " ")
+		if cut <= 0 {
+			cut = maxExcerptLength
+		}
+		text = text[:cut] + " …"
+	}
+	if excerpt == "" {
+		return text
+	}
+	return strings.TrimSuffix(excerpt, ".") + ". " + text
+}
@@ -0,0 +1,201 @@
+package lspserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LineRange is a range of 0-based document lines, both ends included
+type LineRange struct {
+	Start int
+	End   int
+}
+
+/*
+ * ChunkDocument splits a document into chunks of at most maxTokens estimated tokens, counting the
+ * lines as chunkDocument sends them. Chunks end at top-level declarations and function
+ * definitions whenever possible, so the model always sees complete functions. Functions longer
+ * than maxTokens are split between statements of the outermost block that fits, never between an
+ * if and its else. Only a single statement longer than maxTokens is cut at an arbitrary line, a
+ * single line longer than that is sent as a chunk of its own.
+ *
+ * @param lines The document lines
+ * @param maxTokens The maximum number of tokens per chunk, see estimateTokens
+ * @return chunks The line ranges of the chunks in document order
+ */
+func ChunkDocument(lines []string, maxTokens int) []LineRange {
+	boundaries := statementBoundaries(lines)
+
+	var chunks []LineRange
+	for start := 0; start < len(lines); {
+		// The last line that fits, the first one always does
+		end, tokens := start, estimateTokens(numberedLine(start, lines[start]))
+		for end+1 < len(lines) {
+			next := estimateTokens(numberedLine(end+1, lines[end+1]))
+			if tokens+next > maxTokens {
+				break
+			}
+			end, tokens = end+1, tokens+next
+		}
+		if end >= len(lines)-1 {
+			chunks = append(chunks, LineRange{Start: start, End: len(lines) - 1})
+			break
+		}
+
+		// Cut after the last line that ends at the lowest brace depth within the window
+		cut, depth := end, -1
+		for line := start; line <= end; line++ {
+			if d := boundaries[line]; d >= 0 && (depth < 0 || d <= depth) {
+				cut, depth = line, d
+			}
+		}
+		chunks = append(chunks, LineRange{Start: start, End: cut})
+		start = cut + 1
+	}
+	return chunks
+}
+
+/*
+ * statementBoundaries returns, for every line, the brace depth after it when a chunk may end
+ * there and -1 otherwise. A chunk may end after a line that completes a statement, a top-level
+ * declaration, a function definition or a preprocessor directive.
+ */
+func statementBoundaries(lines []string) []int {
+	text := strings.Join(lines, "\n")
+	boundaries := make([]int, len(lines))
+	for i := range boundaries {
+		boundaries[i] = -1
+	}
+
+	// Blocks at the top level are only complete once they are function bodies, struct and
+	// initializer blocks still need their closing semicolon
+	functionEnds := map[int]bool{}
+	for _, f := range FindFunctions(text) {
+		functionEnds[f.EndLine] = true
+	}
+
+	depth, parens, line := 0, 0, 0
+	// The last significant character, 0 at the start of the document
+	var last byte
+	// Boundaries followed by nothing but closing braces so far, none of them is a boundary when
+	// the next word is else or while, the next chunk would start with the end of the if or do
+	var closers []int
+	atLineStart := true
+
+	endLine := func() {
+		switch {
+		case parens > 0:
+		case last == 0 || last == ';':
+			boundaries[line] = depth
+			closers = append(closers, line)
+		case last == '}' && (depth > 0 || functionEnds[line]):
+			boundaries[line] = depth
+			closers = append(closers, line)
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case c == '\n':
+			endLine()
+			line++
+			atLineStart = true
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			continue
+		case c == '#' && atLineStart:
+			// Preprocessor directive, runs to the end of the line including continuations
+			for i+1 < len(text) && text[i+1] != '\n' {
+				if text[i+1] == '\\' && i+2 < len(text) && text[i+2] == '\n' {
+					i++
+					line++
+				}
+				i++
+			}
+			if parens == 0 {
+				boundaries[line] = depth
+			}
+			continue
+		case c == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i+1 < len(text) && text[i+1] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			i++
+			for i+1 < len(text) && !(text[i] == '*' && text[i+1] == '/') {
+				i++
+				if text[i] == '\n' {
+					// Lines ending inside a comment are never boundaries
+					line++
+				}
+			}
+			i++
+			continue
+		}
+
+		atLineStart = false
+
+		if c != '}' {
+			word := text[i:]
+			if n := strings.IndexFunc(word, func(r rune) bool { return !isIdentifierChar(r) }); n >= 0 {
+				word = word[:n]
+			}
+			if last == '}' && (word == "else" || word == "while") {
+				for _, closer := range closers {
+					boundaries[closer] = -1
+				}
+			}
+			closers = nil
+		}
+
+		switch c {
+		case '"', '\'':
+			for i+1 < len(text) && text[i+1] != c && text[i+1] != '\n' {
+				if text[i+1] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+		case '(':
+			parens++
+		case ')':
+			if parens > 0 {
+				parens--
+			}
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		}
+		last = c
+	}
+	if len(lines) > 0 {
+		endLine()
+	}
+
+	return boundaries
+}
+
+func isIdentifierChar(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// chunkQuery is the query sending chunk i of a document, retries lead with the retry prompt
+func chunkQuery(req *AnalysisRequest, i int, chunk sourceChunk) string {
+	query := fmt.Sprintf("FileName: %s\n", req.URI)
+	if chunk.Declarations != "" {
+		query += fmt.Sprintf("Declarations from elsewhere in the file, for context only, do not report findings on them:\n%s",
+			chunk.Declarations)
+	}
+	query += fmt.Sprintf("Source Code (Chunk %d):\n%s", i+1, chunk.Code)
+	if req.RetryPrompt != "" {
+		query = strings.TrimRight(req.RetryPrompt, "\n") + "\n\n" + query
+	}
+	return query
+}
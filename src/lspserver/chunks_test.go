@@ -0,0 +1,54 @@
+package lspserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const controlFlowDocument = `int f(int x)
+{
+    if (x > 0) {
+        x = 1;
+        x = 2;
+    }
+    else {
+        x = 3;
+    }
+    do {
+        x--;
+    }
+    while (x > 0);
+    if (x) {
+        if (x < 0) {
+            x = 4;
+        }
+    }
+    else
+        x = 5;
+    return x;
+}`
+
+func TestStatementBoundaries(t *testing.T) {
+	lines := strings.Split(controlFlowDocument, "\n")
+	// Lines followed by nothing but closing braces up to an else or while are no boundaries either
+	want := []int{-1, -1, -1, 2, -1, -1, -1, 2, 1, -1, -1, -1, 1, -1, -1, -1, -1, -1, -1, 1, 1, 0}
+	if got := statementBoundaries(lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("boundaries %v, want %v", got, want)
+	}
+
+	// Where the window ends inside the if, the next chunk starts with a statement, not with the
+	// end of the if before its else
+	var budget int
+	for _, line := range lines[:5] {
+		budget += estimateTokens(numberedLine(0, line))
+	}
+	chunks := ChunkDocument(lines, budget)
+	if want := []LineRange{{0, 3}, {4, 8}, {9, 12}}; !reflect.DeepEqual(chunks[:3], want) {
+		t.Errorf("chunks %v, want %v first", chunks, want)
+	}
+	// The nested if does not fit with its else, it is cut at the end of the window
+	if chunks[3] != (LineRange{13, 16}) {
+		t.Errorf("chunks %v, want the nested if cut after line 16", chunks)
+	}
+}
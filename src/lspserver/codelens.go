@@ -0,0 +1,180 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// Severities in the order they are listed in a code lens, others follow alphabetically
+var lensSeverityOrder = []string{"mandatory", "required", "advisory"}
+
+/*
+ * OnCodeLens is called when the client shows a document, it returns a lens above every function
+ * with the number of findings per severity. Clicking the lens analyses just that function.
+ *
+ * @param ctx The context of the request.
+ * @param req The code lens params from the client.
+ * @return lenses One lens per function definition
+ * @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnCodeLens(ctx context.Context, req *defines.CodeLensParams) (*[]defines.CodeLens, error) {
+	uri := string(req.TextDocument.Uri)
+	logs.Printf("OnCodeLens called for URI: %s", uri)
+
+	lenses := []defines.CodeLens{}
+	documents := l.documentStore(ctx, uri)
+	text, err := documents.Load(uri)
+	if err != nil {
+		return &lenses, nil
+	}
+	// Documents that were never analysed get a lens too, it is the quickest way to analyse them
+	diagnostics, err := documents.GetDiagnostics(uri)
+
+	for _, f := range FindFunctions(text) {
+		title := "not analysed"
+		if err == nil {
+			title = lensTitle(f, diagnostics)
+		}
+
+		position := defines.Position{Line: uint(f.StartLine)}
+		arguments := []interface{}{uri, f.StartLine}
+		lenses = append(lenses, defines.CodeLens{
+			Range: defines.Range{Start: position, End: position},
+			Command: &defines.Command{
+				Title:     title,
+				Command:   CommandAnalyzeFunction,
+				Arguments: &arguments,
+			},
+		})
+	}
+
+	return &lenses, nil
+}
+
+// lensTitle summarises the findings inside a function, e.g. "3 mandatory · 1 advisory"
+func lensTitle(f CFunction, diagnostics []LspDiagnostic) string {
+	counts := map[string]int{}
+	for _, d := range diagnostics {
+		if d.LineNumber-1 >= f.StartLine && d.LineNumber-1 <= f.EndLine {
+			counts[strings.ToLower(d.Severity)] += 1
+		}
+	}
+	if len(counts) == 0 {
+		return "no findings"
+	}
+
+	var parts []string
+	for _, severity := range lensSeverityOrder {
+		if counts[severity] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[severity], severity))
+			delete(counts, severity)
+		}
+	}
+	var others []string
+	for severity := range counts {
+		others = append(others, severity)
+	}
+	sort.Strings(others)
+	for _, severity := range others {
+		name := severity
+		if name == "" {
+			name = "other"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", counts[severity], name))
+	}
+	return strings.Join(parts, " · ")
+}
+
+/*
+ * analyzeFunction analyses only the function starting at line. Its findings replace the stored
+ * findings within the function, findings elsewhere in the document are kept.
+ *
+ * @param ctx The context of the request.
+ * @param uri The document URI.
+ * @param line The 0-based line of the function signature, as passed by the code lens.
+ * @return error Any error that occurred during the analysis
+ */
+func (l *lspServer) analyzeFunction(ctx context.Context, uri string, line int) error {
+	text, err := l.loadDocument(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	// The document may have changed since the lens was created, look the function up again
+	f, ok := FunctionAt(FindFunctions(text), line)
+	if !ok {
+		return jsonrpc.ResponseError{
+			Code:    jsonrpc.InvalidParamsCode,
+			Message: fmt.Sprintf("no function at line %d", line+1),
+		}
+	}
+
+	lines := splitLines(text)
+	body := strings.Join(lines[f.StartLine:f.EndLine+1], "\n")
+	_, diagnostics, err := l.runAnalysis(ctx, uri, body, "Analysing "+f.Name, nil)
+	if err != nil {
+		return err
+	}
+	// The line numbers only fit the text the function was taken from
+	if !l.isCurrent(ctx, uri, text) {
+		logs.Printf("Dropping the analysis of %s in an outdated version of %s", f.Name, uri)
+		return nil
+	}
+
+	merged := []LspDiagnostic{}
+	documents := l.documentStore(ctx, uri)
+	previous, _ := documents.GetDiagnostics(uri)
+	for _, d := range previous {
+		if d.LineNumber-1 < f.StartLine || d.LineNumber-1 > f.EndLine {
+			merged = append(merged, d)
+		}
+	}
+	for _, d := range diagnostics {
+		d.LineNumber += f.StartLine
+		if d.EndLineNumber > 0 {
+			d.EndLineNumber += f.StartLine
+		}
+		merged = append(merged, d)
+	}
+
+	if err = documents.UpdateDiagnostics(uri, merged); err != nil {
+		return err
+	}
+	l.refreshDiagnostics(ctx)
+	return nil
+}
+
+// functionArguments returns the document URI and function line passed by a code lens
+func functionArguments(req *defines.ExecuteCommandParams) (string, int, error) {
+	uri, err := commandUri(req)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(*req.Arguments) > 1 {
+		// JSON numbers always decode as float64
+		if line, ok := (*req.Arguments)[1].(float64); ok && line >= 0 {
+			return uri, int(line), nil
+		}
+	}
+	return "", 0, jsonrpc.ResponseError{
+		Code:    jsonrpc.InvalidParamsCode,
+		Message: fmt.Sprintf("%s expects a document URI and a line argument", req.Command),
+	}
+}
+
+// refreshCodeLenses asks the client to request code lenses again when it supports the request
+func (l *lspServer) refreshCodeLenses(ctx context.Context) {
+	session := jsonrpc.SessionFromContext(ctx)
+	if session == nil || !l.session(ctx).getCapabilities().codeLensRefresh {
+		return
+	}
+	if err := session.Call(ctx, "workspace/codeLens/refresh", nil, nil); err != nil {
+		logs.Printf("workspace/codeLens/refresh failed: %v", err)
+	}
+}
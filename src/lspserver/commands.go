@@ -0,0 +1,174 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// Commands exposed through workspace/executeCommand
+const (
+	CommandAnalyzeFile      = "llmlint.analyzeFile"
+	CommandAnalyzeWorkspace = "llmlint.analyzeWorkspace"
+	CommandClearCache       = "llmlint.clearCache"
+	CommandCancelAll        = "llmlint.cancelAll"
+	CommandShowRawAnalysis  = "llmlint.showRawAnalysis"
+	CommandAnalyzeFunction  = "llmlint.analyzeFunction"
+)
+
+// Commands lists every command advertised in the ExecuteCommandOptions
+var Commands = []string{
+	CommandAnalyzeFile,
+	CommandAnalyzeWorkspace,
+	CommandClearCache,
+	CommandCancelAll,
+	CommandShowRawAnalysis,
+	CommandAnalyzeFunction,
+}
+
+/*
+ * OnExecuteCommand is called when the user runs one of our commands, usually from the command palette.
+ *
+ * @param ctx The context of the request.
+ * @param req The command and its arguments.
+ * @return result The command result, only llmlint.showRawAnalysis returns one
+ * @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnExecuteCommand(ctx context.Context, req *defines.ExecuteCommandParams) (interface{}, error) {
+	logs.Printf("OnExecuteCommand: %s", req.Command)
+
+	switch req.Command {
+	case CommandAnalyzeFile:
+		uri, err := commandUri(req)
+		if err != nil {
+			return nil, err
+		}
+		return nil, l.analyzeFile(ctx, uri)
+	case CommandAnalyzeWorkspace:
+		return nil, l.analyzeWorkspace(ctx)
+	case CommandClearCache:
+		if session := l.session(ctx); session != nil {
+			session.documents.ClearAnalysis()
+			session.workspace.ClearAnalysis()
+		}
+		l.cache.Clear()
+		l.refreshDiagnostics(ctx)
+		return nil, nil
+	case CommandCancelAll:
+		for _, backend := range l.allBackends() {
+			backend.Cancel()
+		}
+		return nil, nil
+	case CommandShowRawAnalysis:
+		uri, err := commandUri(req)
+		if err != nil {
+			return nil, err
+		}
+		return l.documentStore(ctx, uri).LoadAnalysis(uri)
+	case CommandAnalyzeFunction:
+		uri, line, err := functionArguments(req)
+		if err != nil {
+			return nil, err
+		}
+		return nil, l.analyzeFunction(ctx, uri, line)
+	default:
+		return nil, jsonrpc.ResponseError{
+			Code:    jsonrpc.InvalidParamsCode,
+			Message: fmt.Sprintf("unknown command: %s", req.Command),
+		}
+	}
+}
+
+// commandUri returns the document URI passed as the first command argument
+func commandUri(req *defines.ExecuteCommandParams) (string, error) {
+	if req.Arguments != nil && len(*req.Arguments) > 0 {
+		if uri, ok := (*req.Arguments)[0].(string); ok && uri != "" {
+			return uri, nil
+		}
+	}
+	return "", jsonrpc.ResponseError{
+		Code:    jsonrpc.InvalidParamsCode,
+		Message: fmt.Sprintf("%s expects a document URI argument", req.Command),
+	}
+}
+
+// analyzeFile analyses a single document even if it did not change
+func (l *lspServer) analyzeFile(ctx context.Context, uri string) error {
+	text, err := l.loadDocument(ctx, uri)
+	if err != nil {
+		return err
+	}
+
+	l.cache.Delete(l.cacheText(ctx, uri, text))
+	err = l.analyseDocument(ctx, uri, text)
+	if err != nil {
+		return err
+	}
+	l.refreshDiagnostics(ctx)
+	return nil
+}
+
+// analyzeWorkspace analyses every known document and workspace file again
+func (l *lspServer) analyzeWorkspace(ctx context.Context) error {
+	session := l.session(ctx)
+	if session == nil {
+		return errSessionClosed
+	}
+	documents := session.documents.Dump()
+	for _, uri := range workspaceFiles(session.getWorkspaceFolders(), l.getSettings().Include) {
+		if _, ok := documents[uri]; !ok {
+			documents[uri] = ""
+		}
+	}
+
+	for uri := range documents {
+		text, err := l.loadDocument(ctx, uri)
+		if err == nil {
+			l.cache.Delete(l.cacheText(ctx, uri, text))
+			err = l.analyseDocument(ctx, uri, text)
+		}
+		if err != nil {
+			logs.Printf("Error analysing %s: %v", uri, err)
+		}
+	}
+	l.refreshDiagnostics(ctx)
+	return nil
+}
+
+// loadDocument returns the stored document, documents that are not open are read from disk into
+// the workspace store
+func (l *lspServer) loadDocument(ctx context.Context, uri string) (string, error) {
+	session := l.session(ctx)
+	if session == nil {
+		return "", errSessionClosed
+	}
+	text, err := session.documents.Load(uri)
+	if err == nil {
+		return text, nil
+	}
+
+	text, err = l.readDocument(ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	session.workspace.Store(uri, text)
+	return text, nil
+}
+
+// refreshDiagnostics asks the client to pull diagnostics again when it supports the request, code
+// lenses show the finding counts so they are refreshed too
+func (l *lspServer) refreshDiagnostics(ctx context.Context) {
+	session := jsonrpc.SessionFromContext(ctx)
+	if session == nil {
+		return
+	}
+	if l.session(ctx).getCapabilities().diagnosticRefresh {
+		if err := session.Call(ctx, "workspace/diagnostic/refresh", nil, nil); err != nil {
+			logs.Printf("workspace/diagnostic/refresh failed: %v", err)
+		}
+	}
+	l.refreshCodeLenses(ctx)
+}
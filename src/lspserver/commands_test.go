@@ -0,0 +1,82 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+func TestExecuteCommandInvalid(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession), cache: newAnalysisCache()}
+	noArguments := []interface{}{}
+	wrongArgument := []interface{}{42}
+	noLine := []interface{}{"file:///work/main.c"}
+	for _, req := range []defines.ExecuteCommandParams{
+		{Command: "llmlint.unknown"},
+		{Command: ""},
+		{Command: CommandAnalyzeFile},
+		{Command: CommandAnalyzeFile, Arguments: &noArguments},
+		{Command: CommandShowRawAnalysis, Arguments: &wrongArgument},
+		{Command: CommandAnalyzeFunction, Arguments: &noLine},
+	} {
+		result, err := l.OnExecuteCommand(context.Background(), &req)
+		var responseErr jsonrpc.ResponseError
+		if !errors.As(err, &responseErr) || responseErr.Code != jsonrpc.InvalidParamsCode || result != nil {
+			t.Errorf("%q: %v, %v, want invalid params", req.Command, result, err)
+		}
+	}
+}
+
+func TestExecuteCommandClearCacheAndCancelAll(t *testing.T) {
+	backend := "test-stub"
+	ParamBackend = &backend
+	ParamRoutes = []Route{{Pattern: "*.py", Model: "routed"}}
+	ParamBackends = map[string]json.RawMessage{"test-stub": json.RawMessage(`{"analysis": "[]"}`)}
+	defer func() { ParamBackend, ParamRoutes, ParamBackends = nil, nil, nil }()
+
+	l := NewLspServer("lsp-test").(*lspServer)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	open, background := "file:///work/main.c", "file:///work/util.c"
+	session := l.session(ctx)
+	session.documents.Store(open, "int x;\n")
+	session.documents.UpdateDiagnostics(open, []LspDiagnostic{{LineNumber: 1, Rule: "Rule 8.4"}})
+	session.workspace.Store(background, "int y;\n")
+	session.workspace.UpdateDiagnostics(background, []LspDiagnostic{{LineNumber: 1, Rule: "Rule 8.7"}})
+	l.cache.Store("int x;\n", "[]", nil)
+
+	if _, err := l.OnExecuteCommand(ctx, &defines.ExecuteCommandParams{Command: CommandClearCache}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.documents.GetDiagnostics(open); err == nil {
+		t.Error("diagnostics of the open document kept")
+	}
+	if _, err := session.workspace.GetDiagnostics(background); err == nil {
+		t.Error("diagnostics of the workspace file kept")
+	}
+	if _, ok := l.cache.Load("int x;\n"); ok {
+		t.Error("cached analysis kept")
+	}
+	// Only the analyses are cleared, the documents stay
+	if text, err := session.documents.Load(open); err != nil || text != "int x;\n" {
+		t.Errorf("open document %q, %v", text, err)
+	}
+
+	// Routed backends are cancelled along with the one of the settings
+	if _, _, err := l.documentBackend(ctx, "file:///work/tool.py"); err != nil {
+		t.Fatal(err)
+	}
+	cancels := stub.cancels
+	if _, err := l.OnExecuteCommand(ctx, &defines.ExecuteCommandParams{Command: CommandCancelAll}); err != nil {
+		t.Fatal(err)
+	}
+	if stub.cancels != cancels+2 {
+		t.Errorf("%d backends cancelled, want 2", stub.cancels-cancels)
+	}
+}
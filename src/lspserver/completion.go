@@ -0,0 +1,244 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// maxCompletionContext bounds the prefix and suffix sent with a completion request, in bytes
+const maxCompletionContext = 6000
+
+// maxCompletions is the number of alternatives requested from the model
+const maxCompletions = 3
+
+// completionSeparator is the line the model puts between alternative completions
+const completionSeparator = "<|next|>"
+
+// Fill-in-the-middle markers, see CompletionQuery
+const (
+	fimPrefix = "<|prefix|>"
+	fimSuffix = "<|suffix|>"
+	fimMiddle = "<|middle|>"
+)
+
+// CompletionSystemPrompt instructs the model to fill in the code between a prefix and a suffix
+var CompletionSystemPrompt = fmt.Sprintf(`You are a C code completion engine. You are given the code before the cursor after %s and the code after the cursor after %s.
+Reply with the code to insert at the cursor after %s and nothing else: no explanations, no Markdown, do not repeat the code before or after the cursor.
+Keep the indentation of the surrounding code. You may give up to %d alternatives, best first, separated by a line containing only %s.`,
+	fimPrefix, fimSuffix, fimMiddle, maxCompletions, completionSeparator)
+
+// CompletionQuery builds the fill-in-the-middle query for CompletionSystemPrompt
+func CompletionQuery(prefix string, suffix string) string {
+	return fmt.Sprintf("%s%s%s%s%s", fimPrefix, prefix, fimSuffix, suffix, fimMiddle)
+}
+
+/*
+ * ParseCompletions turns a model response into completion candidates. Code fences and empty
+ * alternatives are dropped, code the model repeated from around the cursor is removed and
+ * duplicates are merged. Candidates keep the order of the model.
+ * @param response The model response to a CompletionQuery
+ * @param prefix The code before the cursor
+ * @param suffix The code after the cursor
+ * @return completions The text to insert at the cursor, best first
+ */
+func ParseCompletions(response string, prefix string, suffix string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(response, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	linePrefix := strings.TrimLeft(prefix[strings.LastIndex(prefix, "\n")+1:], " \t")
+	following := strings.TrimLeft(suffix, " \t\n")
+
+	var completions []string
+	seen := map[string]bool{}
+	for _, candidate := range strings.Split(strings.Join(lines, "\n"), completionSeparator) {
+		candidate = strings.TrimPrefix(candidate, fimMiddle)
+		candidate = strings.TrimRight(strings.TrimPrefix(candidate, "\n"), " \t\n")
+		if trimmed := strings.TrimLeft(candidate, " \t"); linePrefix != "" && strings.HasPrefix(trimmed, linePrefix) {
+			candidate = trimmed[len(linePrefix):]
+		}
+		candidate = strings.TrimSuffix(candidate, suffixOverlap(candidate, following))
+		candidate = strings.TrimRight(candidate, " \t\n")
+
+		key := strings.Join(strings.Fields(candidate), " ")
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		completions = append(completions, candidate)
+	}
+	return completions
+}
+
+// suffixOverlap returns the longest end of candidate that the code after the cursor starts with
+func suffixOverlap(candidate string, following string) string {
+	n := len(candidate)
+	if len(following) < n {
+		n = len(following)
+	}
+	for ; n > 0; n-- {
+		if strings.HasSuffix(candidate, following[:n]) {
+			return following[:n]
+		}
+	}
+	return ""
+}
+
+// rankCompletions moves candidates with unbalanced brackets after the balanced ones, the model
+// order is kept otherwise
+func rankCompletions(completions []string) {
+	sort.SliceStable(completions, func(i, j int) bool {
+		return bracketsBalanced(completions[i]) && !bracketsBalanced(completions[j])
+	})
+}
+
+func bracketsBalanced(code string) bool {
+	depth := map[rune]int{}
+	pairs := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	for _, r := range code {
+		switch r {
+		case '(', '[', '{':
+			depth[r] += 1
+		case ')', ']', '}':
+			depth[pairs[r]] -= 1
+		}
+	}
+	for _, d := range depth {
+		if d != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// positionOffset converts an LSP position, counted in UTF-16 code units, to a byte offset in text
+func positionOffset(text string, position defines.Position) int {
+	offset := 0
+	for line := uint(0); line < position.Line; line++ {
+		next := strings.IndexByte(text[offset:], '\n')
+		if next < 0 {
+			return len(text)
+		}
+		offset += next + 1
+	}
+
+	units := uint(0)
+	for i, r := range text[offset:] {
+		if units >= position.Character || r == '\n' {
+			return offset + i
+		}
+		units += uint(len(utf16.Encode([]rune{r})))
+	}
+	return len(text)
+}
+
+// wordStart returns the byte offset where the identifier ending at offset starts
+func wordStart(text string, offset int) int {
+	start := offset
+	for start > 0 {
+		c := text[start-1]
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			break
+		}
+		start--
+	}
+	return start
+}
+
+/*
+ * OnCompletion asks the backend to fill in the code at the cursor. The in-memory document is sent
+ * as prefix and suffix, each candidate becomes a TextEdit that also replaces the identifier being
+ * typed so clients can filter on it.
+ *
+ * @param ctx The context of the request.
+ * @param req The completion params from the client.
+ * @return result The completion items, best first
+ * @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionParams) (result *[]defines.CompletionItem, err error) {
+	logs.Printf("OnCompletion: %v", req)
+
+	text, err := l.loadDocument(ctx, string(req.TextDocument.Uri))
+	if err != nil {
+		logs.Printf("Error loading document: %v\n", err)
+		return nil, err
+	}
+
+	offset := positionOffset(text, req.Position)
+	start := wordStart(text, offset)
+	word := text[start:offset]
+
+	prefix := text[:offset]
+	if len(prefix) > maxCompletionContext {
+		prefix = prefix[len(prefix)-maxCompletionContext:]
+		prefix = prefix[strings.IndexByte(prefix, '\n')+1:]
+	}
+	suffix := text[offset:]
+	if len(suffix) > maxCompletionContext {
+		suffix = suffix[:strings.LastIndexByte(suffix[:maxCompletionContext], '\n')+1]
+	}
+
+	backend, _, err := l.documentBackend(ctx, string(req.TextDocument.Uri))
+	if err != nil {
+		return nil, err
+	}
+	response, err := backend.CompleteCode(ctx, &CompletionRequest{
+		URI:    string(req.TextDocument.Uri),
+		Prefix: prefix,
+		Suffix: suffix,
+	})
+	if err != nil {
+		l.reportBackendError(err)
+		return nil, err
+	}
+	l.backendAvailable()
+	completions := response.Completions
+	rankCompletions(completions)
+
+	editRange := defines.Range{
+		Start: defines.Position{Line: req.Position.Line, Character: req.Position.Character - uint(len(word))},
+		End:   req.Position,
+	}
+	completionItems := []defines.CompletionItem{}
+	for i, completion := range completions {
+		newText := word + completion
+		lines := strings.Split(newText, "\n")
+		label := strings.TrimSpace(lines[0])
+		detail := "llm completion"
+		if len(lines) > 1 {
+			label += " …"
+			detail = fmt.Sprintf("llm completion, %d lines", len(lines))
+		}
+
+		format := defines.InsertTextFormatPlainText
+		mode := defines.InsertTextModeAsIs
+		completionItems = append(completionItems, defines.CompletionItem{
+			Label:            label,
+			Kind:             kindPtr(defines.CompletionItemKindSnippet),
+			Detail:           strPtr(detail),
+			Documentation:    defines.MarkupContent{Kind: defines.MarkupKindMarkdown, Value: "```c\n" + newText + "\n```"},
+			Preselect:        boolPtr(i == 0),
+			SortText:         strPtr(fmt.Sprintf("%04d", i)),
+			FilterText:       strPtr(newText),
+			InsertTextFormat: &format,
+			InsertTextMode:   &mode,
+			TextEdit:         defines.TextEdit{Range: editRange, NewText: newText},
+		})
+	}
+
+	return &completionItems, nil
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
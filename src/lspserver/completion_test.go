@@ -0,0 +1,103 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+func TestParseCompletions(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		response string
+		prefix   string
+		suffix   string
+		want     []string
+	}{
+		{"plain", "x = 1;", "    ", "\n}", []string{"x = 1;"}},
+		// The model repeats the identifier being typed, only the rest is inserted after it
+		{"repeated prefix in a fence", "```c\nprintf(\"hi\");\n```", "    pri", "\n}", []string{`ntf("hi");`}},
+		{"alternatives", "x = 1;\n" + completionSeparator + "\nx = 2;\n" + completionSeparator + "\n\n", "    ", "", []string{"x = 1;", "x = 2;"}},
+		{"duplicates", "x = 1;\n" + completionSeparator + "\nx  =  1;", "    ", "", []string{"x = 1;"}},
+		{"middle marker", fimMiddle + "return 0;", "    ", "", []string{"return 0;"}},
+		// Code after the cursor the model wrote again is dropped
+		{"repeated suffix", "if (x) {\n        y();\n    }\n}", "    ", "\n}\n", []string{"if (x) {\n        y();\n    }"}},
+		{"CRLF", "a();\r\n" + completionSeparator + "\r\nb();", "", "", []string{"a();", "b();"}},
+		{"empty", "```\n```", "    ", "", nil},
+	} {
+		if got := ParseCompletions(test.response, test.prefix, test.suffix); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPositionOffset(t *testing.T) {
+	// é is two bytes and one UTF-16 unit, 😀 four bytes and two units
+	text := "int x;\ns = \"é😀\"; y\nend"
+	for _, test := range []struct {
+		line, character uint
+		want            int
+	}{
+		{0, 0, 0},
+		{0, 4, 4},
+		{1, 5, 12},
+		{1, 6, 14},
+		{1, 8, 18},
+		{1, 11, 21},
+		// Past the end of the line or the text
+		{1, 40, 22},
+		{2, 3, 26},
+		{5, 0, 26},
+	} {
+		if got := positionOffset(text, defines.Position{Line: test.line, Character: test.character}); got != test.want {
+			t.Errorf("%d:%d: %d, want %d", test.line, test.character, got, test.want)
+		}
+	}
+}
+
+func TestOnCompletionTextEdit(t *testing.T) {
+	backend := "test-stub"
+	ParamBackend = &backend
+	ParamBackends = map[string]json.RawMessage{"test-stub": json.RawMessage(`{}`)}
+	defer func() { ParamBackend, ParamBackends, stub.completions = nil, nil, nil }()
+	l := NewLspServer("lsp-test").(*lspServer)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	uri := "file:///work/main.c"
+	l.documents(ctx).Store(uri, "int main(void)\n{\n    s = \"😀\"; pri\n}\n")
+	stub.completions = []string{"ntf(\"hi\");", "ntf(\"a\"\n    \"b\");", "ntf(\"x\""}
+
+	// The cursor is after "pri", the emoji counts twice
+	position := defines.Position{Line: 2, Character: 17}
+	items, err := l.OnCompletion(ctx, &defines.CompletionParams{TextDocumentPositionParams: defines.TextDocumentPositionParams{
+		TextDocument: defines.TextDocumentIdentifier{Uri: defines.DocumentUri(uri)},
+		Position:     position,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*items) != 3 {
+		t.Fatalf("%d items, want 3", len(*items))
+	}
+	var labels []string
+	for _, item := range *items {
+		labels = append(labels, item.Label)
+		// The edit replaces the identifier being typed so clients filter on it
+		edit := item.TextEdit.(defines.TextEdit)
+		if want := (defines.Range{Start: defines.Position{Line: 2, Character: 14}, End: position}); edit.Range != want {
+			t.Errorf("%s: range %v, want %v", item.Label, edit.Range, want)
+		}
+	}
+	// Unbalanced candidates go last
+	if want := []string{`printf("hi");`, `printf("a" …`, `printf("x"`}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels %q, want %q", labels, want)
+	}
+	if first := (*items)[0]; first.TextEdit.(defines.TextEdit).NewText != `printf("hi");` || !*first.Preselect {
+		t.Errorf("first item %+v", first)
+	}
+}
@@ -0,0 +1,192 @@
+package lspserver
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// chunkOverlapLines is how many lines of the neighbouring chunks are sent around a chunk
+const chunkOverlapLines = 3
+
+// declarationShare is the part of a chunk's token budget, one in declarationShare, kept for its
+// overlap and the file-level declarations it uses
+const declarationShare = 4
+
+var identifierRe = regexp.MustCompile(`[A-Za-z_]\w*`)
+
+var commentRe = regexp.MustCompile(`(?s)/\*.*?\*/|//[^\n]*`)
+
+// Directives that only make sense with the code around them
+var conditionalDirectiveRe = regexp.MustCompile(`^#\s*(if|ifdef|ifndef|elif|else|endif|pragma|error|warning|line)\b`)
+
+// The directive name is no identifier of the file
+var directiveNameRe = regexp.MustCompile(`^#\s*\w+`)
+
+// cKeywords never tie a declaration to the code using it
+var cKeywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true, "continue": true,
+	"default": true, "do": true, "double": true, "else": true, "enum": true, "extern": true,
+	"float": true, "for": true, "goto": true, "if": true, "inline": true, "int": true, "long": true,
+	"register": true, "restrict": true, "return": true, "short": true, "signed": true,
+	"sizeof": true, "static": true, "struct": true, "switch": true, "typedef": true, "union": true,
+	"unsigned": true, "void": true, "volatile": true, "while": true, "_Bool": true,
+}
+
+// sourceChunk is the part of a document sent with one request, see chunkQuery
+type sourceChunk struct {
+	// Numbered file-level lines the code uses, empty when there are none
+	Declarations string
+	// Numbered lines of the chunk including the overlap with its neighbours
+	Code string
+}
+
+// fileDeclaration is a file-level declaration, directive or function signature, lines are 0-based
+type fileDeclaration struct {
+	Start int
+	End   int
+	// The numbered lines
+	Text string
+	// Identifiers declared or used, the chunks using any of them get the declaration
+	Names map[string]bool
+	// Includes go with every chunk
+	Include bool
+}
+
+// identifiers returns the identifiers of code, neither comments nor keywords count
+func identifiers(code string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range identifierRe.FindAllString(commentRe.ReplaceAllString(code, " "), -1) {
+		if !cKeywords[name] {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+/*
+ * fileDeclarations collects what code outside the current chunk may depend on: includes, macros,
+ * type and variable declarations at the top level, and the signatures of the function
+ * definitions. Conditional directives are left out, without the code between them they mislead.
+ *
+ * @param lines The document lines
+ * @return declarations The declarations in document order
+ */
+func fileDeclarations(lines []string) []fileDeclaration {
+	text := strings.Join(lines, "\n")
+	boundaries := statementBoundaries(lines)
+
+	var declarations []fileDeclaration
+	inFunction := make([]bool, len(lines))
+	for _, f := range FindFunctions(text) {
+		for line := f.StartLine; line <= f.EndLine && line < len(lines); line++ {
+			inFunction[line] = true
+		}
+
+		// The signature ends where the body starts
+		var signature strings.Builder
+		end := f.StartLine
+		for ; end <= f.EndLine; end++ {
+			line := lines[end]
+			if brace := strings.Index(line, "{"); brace >= 0 {
+				if prefix := strings.TrimRight(line[:brace], " \t"); strings.TrimSpace(prefix) != "" {
+					signature.WriteString(numberedLine(end, prefix))
+				} else {
+					end--
+				}
+				break
+			}
+			signature.WriteString(numberedLine(end, line))
+		}
+		if signature.Len() > 0 {
+			declarations = append(declarations, fileDeclaration{
+				Start: f.StartLine,
+				End:   end,
+				Text:  signature.String(),
+				Names: map[string]bool{f.Name: true},
+			})
+		}
+	}
+
+	start := -1
+	for line := range lines {
+		if inFunction[line] {
+			start = -1
+			continue
+		}
+		if start < 0 {
+			start = line
+		}
+		if boundaries[line] != 0 && line < len(lines)-1 {
+			continue
+		}
+
+		var numbered strings.Builder
+		for j := start; j <= line; j++ {
+			numbered.WriteString(numberedLine(j, lines[j]))
+		}
+		code := strings.TrimSpace(commentRe.ReplaceAllString(strings.Join(lines[start:line+1], "\n"), " "))
+		declaration := fileDeclaration{Start: start, End: line, Text: numbered.String()}
+		start = -1
+
+		switch {
+		case code == "" || conditionalDirectiveRe.MatchString(code):
+			continue
+		case strings.HasPrefix(code, "#"):
+			declaration.Include = strings.HasPrefix(strings.Join(strings.Fields(code), ""), "#include")
+			declaration.Names = identifiers(directiveNameRe.ReplaceAllString(code, ""))
+		default:
+			declaration.Names = identifiers(code)
+		}
+		declarations = append(declarations, declaration)
+	}
+
+	sort.SliceStable(declarations, func(i, j int) bool { return declarations[i].Start < declarations[j].Start })
+	return declarations
+}
+
+/*
+ * chunkDocument splits the document lines into chunks fitting maxTokens, every line prefixed with
+ * its line number. Each chunk overlaps its neighbours by chunkOverlapLines and carries the
+ * declarations before it that it uses, so the model neither misses the code around a cut nor
+ * flags names declared in other chunks. Findings in the overlap are reported twice, see
+ * mergeDuplicates.
+ *
+ * @param lines The document lines
+ * @param maxTokens The budget of a chunk including its declarations, see chunkTokenBudget
+ * @return chunks The chunks in document order
+ */
+func chunkDocument(lines []string, maxTokens int) []sourceChunk {
+	declarations := fileDeclarations(lines)
+
+	var chunks []sourceChunk
+	for _, r := range ChunkDocument(lines, maxTokens-maxTokens/declarationShare) {
+		start := max(r.Start-chunkOverlapLines, 0)
+		end := min(r.End+chunkOverlapLines, len(lines)-1)
+
+		var code strings.Builder
+		for j := start; j <= end; j++ {
+			code.WriteString(numberedLine(j, lines[j]))
+		}
+		used := identifiers(strings.Join(lines[start:end+1], "\n"))
+
+		// The declarations take what the code leaves, the earliest first
+		var header strings.Builder
+		left := maxTokens - estimateTokens(code.String())
+		for _, declaration := range declarations {
+			if declaration.End >= start {
+				continue
+			}
+			relevant := declaration.Include
+			for name := range declaration.Names {
+				relevant = relevant || used[name]
+			}
+			if tokens := estimateTokens(declaration.Text); relevant && tokens <= left {
+				header.WriteString(declaration.Text)
+				left -= tokens
+			}
+		}
+		chunks = append(chunks, sourceChunk{Declarations: header.String(), Code: code.String()})
+	}
+	return chunks
+}
@@ -0,0 +1,99 @@
+package lspserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const declarationsDocument = `#include <stdio.h>
+#define LIMIT 10
+#ifdef DEBUG
+static int unused_flag = 1;
+#endif
+static int counter = 0;
+
+typedef struct {
+    int x;
+} point_t;
+
+int scale(int value)
+{
+    return value * LIMIT;
+}
+
+int count(void)
+{
+    counter++;
+    return counter;
+}
+
+int main(void)
+{
+    point_t p = { scale(2) };
+    printf("%d\n", p.x);
+    return count();
+}`
+
+func TestChunkDocumentDeclarations(t *testing.T) {
+	lines := splitLines(declarationsDocument)
+	// Small enough to put main in a chunk of its own
+	chunks := chunkDocument(lines, 240)
+	if len(chunks) < 2 {
+		t.Fatalf("%d chunks, want main in its own", len(chunks))
+	}
+	last := chunks[len(chunks)-1]
+
+	for _, want := range []string{
+		"Line 1: #include <stdio.h>\n",
+		"Line 8: typedef struct {\nLine 9:     int x;\nLine 10: } point_t;\n",
+		"Line 12: int scale(int value)\n",
+		"Line 17: int count(void)\n",
+	} {
+		if !strings.Contains(last.Declarations, want) {
+			t.Errorf("declarations of main lack %q:\n%s", want, last.Declarations)
+		}
+	}
+	// Neither unused declarations nor conditional directives nor function bodies
+	for _, unwanted := range []string{"LIMIT", "#ifdef", "unused_flag", "return"} {
+		if strings.Contains(last.Declarations, unwanted) {
+			t.Errorf("declarations of main contain %q:\n%s", unwanted, last.Declarations)
+		}
+	}
+
+	// Every chunk starts with the last lines of the one before
+	for i := 1; i < len(chunks); i++ {
+		previous := strings.Split(strings.TrimSuffix(chunks[i-1].Code, "\n"), "\n")
+		overlap := strings.Join(previous[len(previous)-2*chunkOverlapLines:len(previous)-chunkOverlapLines], "\n")
+		if !strings.HasPrefix(chunks[i].Code, overlap) {
+			t.Errorf("chunk %d does not overlap chunk %d:\n%s", i+1, i, chunks[i].Code)
+		}
+	}
+	if !strings.HasPrefix(chunks[0].Code, "Line 1: ") || !strings.HasSuffix(last.Code, fmt.Sprintf("Line %d: }\n", len(lines))) {
+		t.Errorf("chunks do not cover the document")
+	}
+}
+
+func TestMergeDuplicates(t *testing.T) {
+	analysis := `[
+		{"line_number": 3, "rule": "Rule 10.4", "description": "first"},
+		{"line_number": 3, "rule": "rule 10.4", "snippet": "x + 1u", "description": "second", "recommendation": "cast"},
+		{"line_number": 3, "rule": "Rule 10.4", "snippet": "y + 2u", "description": "other operand"},
+		{"line_number": 3, "rule": "Rule 15.5", "description": "other rule"},
+		{"line_number": 4, "rule": "Rule 10.4", "description": "other line"}
+	]`
+	diagnostics, err := DiagnosticsUnmarshal("file:///a.c", analysis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descriptions []string
+	for _, d := range diagnostics {
+		descriptions = append(descriptions, d.Description)
+	}
+	if want := "first,other operand,other rule,other line"; strings.Join(descriptions, ",") != want {
+		t.Errorf("findings %v, want %s", descriptions, want)
+	}
+	if diagnostics[0].Snippet != "x + 1u" || diagnostics[0].Recommendation != "cast" {
+		t.Errorf("merged finding %+v lacks the fields of its duplicate", diagnostics[0])
+	}
+}
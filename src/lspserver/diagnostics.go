@@ -4,13 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
 	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
 )
 
 // See ./prompts/prompt_base.txt
 type LspDiagnostic struct {
 	Uri            string `json:"uri"`
 	LineNumber     int    `json:"line_number"`
+	EndLineNumber  int    `json:"end_line_number,omitempty"`
+	Column         int    `json:"column,omitempty"`
+	LineContent    string `json:"line_content,omitempty"`
+	Snippet        string `json:"snippet,omitempty"`
 	Source         string `json:"source"`
 	Rule           string `json:"rule"`
 	Severity       string `json:"severity"`
@@ -18,40 +27,74 @@ type LspDiagnostic struct {
 	Recommendation string `json:"recommendation"`
 }
 
+// severityBadges prefix the severity in hovers, unknown severities get the default badge
+var severityBadges = map[string]string{
+	"mandatory": "🔴",
+	"required":  "🟠",
+	"advisory":  "🟡",
+}
+
+func severityBadge(severity string) string {
+	if badge, ok := severityBadges[strings.ToLower(severity)]; ok {
+		return badge
+	}
+	return "🔵"
+}
+
 /*
- * DiagnosticToPrettyText takes a LspDiagnostic struct and returns a string with the fields formatted
- * @param d The LspDiagnostic struct to format
- * @return ret The formatted string
-*/
-func DiagnosticToPrettyText(d LspDiagnostic) string {
-	const fmtString string = `
-Source: %s
-Severity: %s
-Recommendation: %s
-`
-	return fmt.Sprintf(fmtString, d.Source, d.Severity, d.Recommendation)
+ * DiagnosticsToMarkdown renders findings as Markdown for the hover callback, each with its rule,
+ * severity badge, description, recommendation and, when the rule is known, a catalog excerpt.
+ * @param diagnostics The findings to render
+ * @param catalog The rule catalog, may be empty
+ * @return ret The Markdown text
+ */
+func DiagnosticsToMarkdown(diagnostics []LspDiagnostic, catalog RuleCatalog) string {
+	var parts []string
+	for _, d := range diagnostics {
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("#### %s %s %s `%s`\n\n", severityBadge(d.Severity), d.Source, d.Rule, d.Severity))
+		b.WriteString(d.Description + "\n")
+		if d.Recommendation != "" {
+			b.WriteString("\n**Recommendation:** " + d.Recommendation + "\n")
+		}
+		if e, ok := catalog.Lookup(d.Source, d.Rule); ok {
+			category := ""
+			if e.Category != "" {
+				category = " (" + e.Category + ")"
+			}
+			b.WriteString(fmt.Sprintf("\n> **%s**%s: %s\n", e.Rule, category, e.Excerpt()))
+		}
+		parts = append(parts, b.String())
+	}
+	return strings.Join(parts, "\n---\n\n")
 }
 
 /*
- * DiagnosticToJsonMarkup takes a LspDiagnostic struct and returns a string with the fields formatted as JSON
- * and using markdown markup. Mainly used by the hover callback.
- * @param d The LspDiagnostic struct to format
- * @return ret The formatted string
- * @return error Any error that occurred during marshalling
-*/
-func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
-	
-	value, err := json.MarshalIndent(d, "", "  ")
-	
-	if err != nil {
-		return "", err
-	}
-
-	return fmt.Sprintf("#### diagnostics\n```json\n%s\n```", string(value)), nil
+ * DiagnosticsToPlainText is the DiagnosticsToMarkdown fallback for clients without Markdown support.
+ * @param diagnostics The findings to render
+ * @param catalog The rule catalog, may be empty
+ * @return ret The plain text
+ */
+func DiagnosticsToPlainText(diagnostics []LspDiagnostic, catalog RuleCatalog) string {
+	var parts []string
+	for _, d := range diagnostics {
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("%s %s [%s]\n", d.Source, d.Rule, d.Severity))
+		b.WriteString(d.Description + "\n")
+		if d.Recommendation != "" {
+			b.WriteString("Recommendation: " + d.Recommendation + "\n")
+		}
+		if e, ok := catalog.Lookup(d.Source, d.Rule); ok {
+			b.WriteString(fmt.Sprintf("%s: %s\n", e.Rule, e.Excerpt()))
+		}
+		parts = append(parts, b.String())
+	}
+	return strings.Join(parts, "\n")
 }
 
 /*
- * DiagnosticsUnmarshal takes a JSON object in a string format and unmarshals it into a slice of LspDiagnostic structs
+ * DiagnosticsUnmarshal takes a JSON object in a string format and unmarshals it into a slice of LspDiagnostic structs.
+ * Structured output, see findingsSchema, is decoded as is, anything else is searched for JSON arrays.
  * @param analysis The string to unmarshal
  * @return diagnostics A slice of LspDiagnostic structs
  * @return error Any error that occurred during unmarshalling
@@ -60,6 +103,14 @@ func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
  func DiagnosticsUnmarshal(uri, analysis string) ([]LspDiagnostic, error) {
 	logs.Printf("Analyse Document: %s", analysis)
 
+	allDiagnostics, structured := structuredFindings(analysis)
+	if structured {
+		for i := range allDiagnostics {
+			allDiagnostics[i].Uri = uri
+		}
+		return mergeDuplicates(allDiagnostics), nil
+	}
+
 	// Define a regular expression to find JSON arrays in the input
 	re := regexp.MustCompile(`\[\s*\{[^]]+\}\s*\]`)
 	matches := re.FindAllString(analysis, -1)
@@ -68,8 +119,6 @@ func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
 		return nil, fmt.Errorf("no valid JSON array found")
 	}
 
-	var allDiagnostics []LspDiagnostic
-
 	for _, match := range matches {
 		var diagnostics []LspDiagnostic
 		err := json.Unmarshal([]byte(match), &diagnostics)
@@ -86,5 +135,223 @@ func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
 			allDiagnostics[i].Uri, allDiagnostics[i].LineNumber, allDiagnostics[i].Rule, allDiagnostics[i].Severity, allDiagnostics[i].Description, allDiagnostics[i].Recommendation)
 	}
 
-	return allDiagnostics, nil
+	return mergeDuplicates(allDiagnostics), nil
+}
+
+// sameFinding tells whether two findings report the same issue, e.g. from the overlap of two chunks
+func sameFinding(a, b LspDiagnostic) bool {
+	if a.LineNumber != b.LineNumber || !strings.EqualFold(strings.TrimSpace(a.Rule), strings.TrimSpace(b.Rule)) {
+		return false
+	}
+	// Different snippets on a line are different issues
+	return a.Snippet == "" || b.Snippet == "" || strings.TrimSpace(a.Snippet) == strings.TrimSpace(b.Snippet)
+}
+
+/*
+ * mergeDuplicates drops the findings reported more than once, which overlapping chunks and
+ * analysis retries produce. The first report of an issue is kept, the fields it lacks are taken
+ * from the later ones.
+ * @param diagnostics The findings in the order they were reported
+ * @return merged The findings without duplicates, in the same order
+ */
+func mergeDuplicates(diagnostics []LspDiagnostic) []LspDiagnostic {
+	if diagnostics == nil {
+		return nil
+	}
+	merged := make([]LspDiagnostic, 0, len(diagnostics))
+	for _, d := range diagnostics {
+		i := slices.IndexFunc(merged, func(m LspDiagnostic) bool { return sameFinding(m, d) })
+		if i < 0 {
+			merged = append(merged, d)
+			continue
+		}
+		m := &merged[i]
+		if m.EndLineNumber == 0 {
+			m.EndLineNumber = d.EndLineNumber
+		}
+		if m.Column == 0 {
+			m.Column = d.Column
+		}
+		if m.Snippet == "" {
+			m.Snippet = d.Snippet
+		}
+		if m.Severity == "" {
+			m.Severity = d.Severity
+		}
+		if m.Recommendation == "" {
+			m.Recommendation = d.Recommendation
+		}
+	}
+	if len(merged) < len(diagnostics) {
+		logs.Printf("Merged %d duplicate findings", len(diagnostics)-len(merged))
+	}
+	return merged
+}
+
+// lineSearchWindow is how far away from the reported line we look for the
+// flagged code when the model gets the line number slightly wrong.
+const lineSearchWindow = 3
+
+/*
+ * DiagnosticRange computes the editor range covered by a diagnostic. The range is derived from
+ * the offending snippet when the model supplied one, then from the column, and finally falls
+ * back to the trimmed full line. Findings spanning several lines (e.g. a whole function body)
+ * cover everything from the first to the last flagged line. The range always lies within the
+ * document.
+ * @param d The LspDiagnostic to locate
+ * @param text The document text the diagnostic was produced for
+ * @return ret The range in LSP (UTF-16) coordinates
+ */
+func DiagnosticRange(d LspDiagnostic, text string) defines.Range {
+	lines := splitLines(text)
+	start := d.LineNumber - 1
+	if start < 0 {
+		start = 0
+	}
+
+	// Lines past the end of the document, e.g. of an older version, end up on its last line. The
+	// empty line after a final newline is no line of its own.
+	last := len(lines) - 1
+	if last > 0 && lines[last] == "" {
+		last--
+	}
+	if start > last {
+		start = last
+	}
+
+	end := d.EndLineNumber - 1
+	if end < start {
+		end = start
+	}
+	if end > last {
+		end = last
+	}
+
+	snippet := strings.Trim(d.Snippet, "\r\n")
+	if snippet == "" {
+		snippet = strings.TrimSpace(d.LineContent)
+	}
+
+	if snippet != "" {
+		if r, ok := snippetRange(lines, start, end, snippet); ok {
+			return r
+		}
+	}
+
+	startChar, _ := trimmedBounds(lines[start])
+	if offset, ok := columnOffset(lines[start], d.Column); ok {
+		startChar = offset
+	}
+	_, endChar := trimmedBounds(lines[end])
+	if end == start && endChar <= startChar {
+		endChar = len(lines[end])
+	}
+
+	return defines.Range{
+		Start: defines.Position{Line: uint(start), Character: utf16Offset(lines[start], startChar)},
+		End:   defines.Position{Line: uint(end), Character: utf16Offset(lines[end], endChar)},
+	}
+}
+
+// snippetRange locates snippet near the reported lines. Single line snippets are searched in a
+// small window around the reported line, multi-line snippets are anchored on their first and
+// last non-empty lines.
+func snippetRange(lines []string, start, end int, snippet string) (defines.Range, bool) {
+	var parts []string
+	for _, p := range splitLines(snippet) {
+		if strings.TrimSpace(p) != "" {
+			parts = append(parts, strings.TrimSpace(p))
+		}
+	}
+	if len(parts) == 0 {
+		return defines.Range{}, false
+	}
+
+	first, last := parts[0], parts[len(parts)-1]
+	for _, line := range nearbyLines(start, len(lines)) {
+		col := strings.Index(lines[line], first)
+		if col < 0 {
+			continue
+		}
+		if len(parts) == 1 {
+			endLine, endCol := line+end-start, col+len(first)
+			if endLine >= len(lines) {
+				endLine = len(lines) - 1
+			}
+			if endLine != line {
+				_, endCol = trimmedBounds(lines[endLine])
+			}
+			return defines.Range{
+				Start: defines.Position{Line: uint(line), Character: utf16Offset(lines[line], col)},
+				End:   defines.Position{Line: uint(endLine), Character: utf16Offset(lines[endLine], endCol)},
+			}, true
+		}
+		// The last line lies within the reported span, give or take the search window
+		lastLine := min(line+max(end-start, len(parts)-1)+lineSearchWindow, len(lines)-1)
+		for endLine := line + 1; endLine <= lastLine; endLine++ {
+			endCol := strings.Index(lines[endLine], last)
+			if endCol < 0 {
+				continue
+			}
+			endCol += len(last)
+			return defines.Range{
+				Start: defines.Position{Line: uint(line), Character: utf16Offset(lines[line], col)},
+				End:   defines.Position{Line: uint(endLine), Character: utf16Offset(lines[endLine], endCol)},
+			}, true
+		}
+	}
+
+	return defines.Range{}, false
+}
+
+// nearbyLines returns the reported line first, followed by its neighbours in increasing distance.
+func nearbyLines(line, count int) []int {
+	candidates := []int{line}
+	for delta := 1; delta <= lineSearchWindow; delta++ {
+		if line-delta >= 0 {
+			candidates = append(candidates, line-delta)
+		}
+		if line+delta < count {
+			candidates = append(candidates, line+delta)
+		}
+	}
+	return candidates
+}
+
+// trimmedBounds returns the byte offsets of the first and one past the last non-blank character.
+func trimmedBounds(line string) (int, int) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return 0, len(line)
+	}
+	start := strings.Index(line, trimmed)
+	return start, start + len(trimmed)
+}
+
+// columnOffset converts the 1-based character column of a finding into a byte offset within line,
+// false when the column is unset or past the end of the line.
+func columnOffset(line string, column int) (int, bool) {
+	if column <= 0 {
+		return 0, false
+	}
+	characters := 0
+	for offset := range line {
+		characters++
+		if characters == column {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// utf16Offset converts a byte offset within line into the UTF-16 based character offset used by LSP.
+func utf16Offset(line string, offset int) uint {
+	if offset > len(line) {
+		offset = len(line)
+	}
+	return uint(len(utf16.Encode([]rune(line[:offset]))))
+}
+
+func splitLines(text string) []string {
+	return strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
 }
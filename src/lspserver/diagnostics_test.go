@@ -0,0 +1,211 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+const rangeDocument = `int main(void)
+{
+    int x = 1; /* é */ x = x + 1u;
+    const char *s = "😀"; s = 0;
+    if (x > 0) {
+        x--;
+    }
+    return x;
+}
+/* filler */
+/* filler */
+/* filler */
+/* filler */
+/* end */`
+
+func TestDiagnosticRange(t *testing.T) {
+	position := func(line, character uint) defines.Position {
+		return defines.Position{Line: line, Character: character}
+	}
+	for _, test := range []struct {
+		name       string
+		diagnostic LspDiagnostic
+		start, end defines.Position
+	}{
+		{"trimmed line", LspDiagnostic{LineNumber: 8}, position(7, 4), position(7, 13)},
+		{"ascii column", LspDiagnostic{LineNumber: 3, Column: 9}, position(2, 8), position(2, 34)},
+		// Characters after the é are one byte further, and in UTF-16 one unit
+		{"column after accent", LspDiagnostic{LineNumber: 3, Column: 24}, position(2, 23), position(2, 34)},
+		// The emoji is two UTF-16 units and four bytes
+		{"column after emoji", LspDiagnostic{LineNumber: 4, Column: 26}, position(3, 26), position(3, 32)},
+		{"column past the line", LspDiagnostic{LineNumber: 8, Column: 40}, position(7, 4), position(7, 13)},
+		{"snippet", LspDiagnostic{LineNumber: 3, Snippet: "x + 1u"}, position(2, 27), position(2, 33)},
+		{"snippet after emoji", LspDiagnostic{LineNumber: 4, Snippet: "s = 0"}, position(3, 26), position(3, 31)},
+		{"snippet on a nearby line", LspDiagnostic{LineNumber: 7, Snippet: "return x;"}, position(7, 4), position(7, 13)},
+		{"multi-line snippet", LspDiagnostic{LineNumber: 5, Snippet: "if (x > 0) {\n    x--;\n}"}, position(4, 4), position(6, 5)},
+		// A last line far below the reported span is not the end of the snippet
+		{"multi-line snippet outside the span", LspDiagnostic{LineNumber: 8, Snippet: "return x;\n/* end */"},
+			position(7, 4), position(7, 13)},
+		{"multi-line finding", LspDiagnostic{LineNumber: 5, EndLineNumber: 7}, position(4, 4), position(6, 5)},
+		// The last line is "/* end */"
+		{"line past the document", LspDiagnostic{LineNumber: 20}, position(13, 0), position(13, 9)},
+		{"column past the document", LspDiagnostic{LineNumber: 20, Column: 40}, position(13, 0), position(13, 9)},
+		{"snippet past the document", LspDiagnostic{LineNumber: 20, Snippet: "end"}, position(13, 3), position(13, 6)},
+	} {
+		r := DiagnosticRange(test.diagnostic, rangeDocument)
+		if r.Start != test.start || r.End != test.end {
+			t.Errorf("%s: %v-%v, want %v-%v", test.name, r.Start, r.End, test.start, test.end)
+		}
+	}
+
+	// The empty line after the final newline does not count
+	if r := DiagnosticRange(LspDiagnostic{LineNumber: 5, EndLineNumber: 9}, "int x;\nint y;\n"); r.Start != position(1, 0) || r.End != position(1, 6) {
+		t.Errorf("past a final newline: %v-%v", r.Start, r.End)
+	}
+	if r := DiagnosticRange(LspDiagnostic{LineNumber: 3}, ""); r.Start != position(0, 0) || r.End != position(0, 0) {
+		t.Errorf("empty document: %v-%v", r.Start, r.End)
+	}
+}
+
+func TestDiagnosticItemsSeverity(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession)}
+	ctx := context.Background()
+	uri := "file:///work/main.c"
+	documents := l.documents(ctx)
+	documents.Store(uri, "int x;\n")
+	documents.UpdateDiagnostics(uri, []LspDiagnostic{
+		{LineNumber: 1, Rule: "Rule 1", Severity: "mandatory"},
+		{LineNumber: 1, Rule: "Rule 2", Severity: "required"},
+		{LineNumber: 1, Rule: "Rule 3", Severity: "advisory"},
+		{LineNumber: 1, Rule: "Rule 4", Severity: "other"},
+	})
+
+	items, err := l.diagnosticItems(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []defines.DiagnosticSeverity{
+		defines.DiagnosticSeverityError,
+		defines.DiagnosticSeverityError,
+		defines.DiagnosticSeverityWarning,
+		defines.DiagnosticSeverityHint,
+	}
+	if len(items) != len(want) {
+		t.Fatalf("%d items, want %d", len(items), len(want))
+	}
+	for i, item := range items {
+		if diagnostic := item.(defines.Diagnostic); *diagnostic.Severity != want[i] {
+			t.Errorf("%s: severity %v, want %v", diagnostic.Code, *diagnostic.Severity, want[i])
+		}
+	}
+}
+
+// hoverFindings are two findings on line 5, the first with a catalog entry
+var hoverFindings = []LspDiagnostic{
+	{LineNumber: 5, Source: "MISRA C:2012", Rule: "Rule 17.7", Severity: "required",
+		Description: "Return value unused.", Recommendation: "Cast to void."},
+	{LineNumber: 3, EndLineNumber: 6, Source: "MISRA C:2012", Rule: "Rule 15.5", Severity: "advisory",
+		Description: "Several exits."},
+}
+
+var hoverCatalog = RuleCatalog{
+	ruleCatalogKey("MISRA C:2012", "Rule 17.7"): {Source: "MISRA C:2012", Rule: "Rule 17.7",
+		Title: "Use return values", Category: "Required"},
+}
+
+func TestDiagnosticsToMarkdown(t *testing.T) {
+	want := "#### 🟠 MISRA C:2012 Rule 17.7 `required`\n\nReturn value unused.\n\n" +
+		"**Recommendation:** Cast to void.\n\n> **Rule 17.7** (Required): Use return values\n" +
+		"\n---\n\n" +
+		"#### 🟡 MISRA C:2012 Rule 15.5 `advisory`\n\nSeveral exits.\n"
+	if got := DiagnosticsToMarkdown(hoverFindings, hoverCatalog); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDiagnosticsToPlainText(t *testing.T) {
+	want := "MISRA C:2012 Rule 17.7 [required]\nReturn value unused.\nRecommendation: Cast to void.\n" +
+		"Rule 17.7: Use return values\n" +
+		"\n" +
+		"MISRA C:2012 Rule 15.5 [advisory]\nSeveral exits.\n"
+	if got := DiagnosticsToPlainText(hoverFindings, hoverCatalog); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOnHover(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession), catalog: hoverCatalog}
+	ctx := context.Background()
+	uri := "file:///work/main.c"
+	l.documents(ctx).Store(uri, rangeDocument)
+	l.documents(ctx).UpdateDiagnostics(uri, hoverFindings)
+	hover := func(line uint) *defines.Hover {
+		result, err := l.OnHover(ctx, &defines.HoverParams{TextDocumentPositionParams: defines.TextDocumentPositionParams{
+			TextDocument: defines.TextDocumentIdentifier{Uri: defines.DocumentUri(uri)},
+			Position:     defines.Position{Line: line},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Line 5 has both findings, line 4 only the one spanning lines 3 to 6
+	if result := hover(4); result == nil || result.Contents.(defines.MarkupContent).Value != DiagnosticsToMarkdown(hoverFindings, hoverCatalog) {
+		t.Errorf("line 5: %+v", result)
+	}
+	if result := hover(3); result == nil || result.Contents.(defines.MarkupContent).Value != DiagnosticsToMarkdown(hoverFindings[1:], hoverCatalog) {
+		t.Errorf("line 4: %+v", result)
+	}
+	if result := hover(7); result != nil {
+		t.Errorf("line 8 without findings: %+v", result)
+	}
+
+	l.session(ctx).hoverKind = defines.MarkupKindPlainText
+	result := hover(4)
+	if contents := result.Contents.(defines.MarkupContent); contents.Kind != defines.MarkupKindPlainText ||
+		contents.Value != DiagnosticsToPlainText(hoverFindings, hoverCatalog) {
+		t.Errorf("plain text client: %+v", contents)
+	}
+}
+
+func TestOnDiagnosticResultIds(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession)}
+	ctx := context.Background()
+	uri := "file:///work/main.c"
+	documents := l.documents(ctx)
+	documents.Store(uri, "int x;\n")
+	documents.UpdateDiagnostics(uri, []LspDiagnostic{{LineNumber: 1, Rule: "Rule 8.4"}})
+	pull := func(previous *string) defines.DocumentDiagnosticReport {
+		report, err := l.OnDiagnostic(ctx, &defines.DocumentDiagnosticParams{
+			TextDocument:     defines.TextDocumentIdentifier{Uri: defines.DocumentUri(uri)},
+			PreviousResultId: previous,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	full, ok := pull(nil).(defines.FullDocumentDiagnosticReport)
+	if !ok || full.Kind != defines.DocumentDiagnosticReportKindFull || full.ResultId == nil || len(full.Items) != 1 {
+		t.Fatalf("first pull %+v", full)
+	}
+	unchanged, ok := pull(full.ResultId).(defines.UnchangedDocumentDiagnosticReport)
+	if !ok || unchanged.Kind != defines.DocumentDiagnosticReportKindUnChanged || unchanged.ResultId != *full.ResultId {
+		t.Errorf("pull with the current result id %+v", unchanged)
+	}
+	// The kind the protocol defines, clients ignore unknown ones
+	if data, _ := json.Marshal(unchanged); !strings.Contains(string(data), `"kind":"unchanged"`) {
+		t.Errorf("unchanged report %s", data)
+	}
+
+	// New diagnostics, or a result id the server does not know, get a full report
+	documents.UpdateDiagnostics(uri, nil)
+	for _, previous := range []string{*full.ResultId, "unknown"} {
+		if report, ok := pull(&previous).(defines.FullDocumentDiagnosticReport); !ok || *report.ResultId == *full.ResultId {
+			t.Errorf("pull with result id %q: %+v", previous, report)
+		}
+	}
+}
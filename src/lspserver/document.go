@@ -4,6 +4,10 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/TobiasYin/go-lsp/logs"
 )
 
@@ -16,13 +20,23 @@ type LspDocuments interface {
 	StoreAnalysis(uri string, analysis string) error
 	UpdateDiagnostics(uri string, diagnostics []LspDiagnostic) error
 	GetDiagnostics(uri string) ([]LspDiagnostic, error)
+	// ResultId identifies the current text and diagnostics of a document, empty when there are none
+	ResultId(uri string) string
+	ClearAnalysis()
 }
 
 type lspDocuments struct {
+	// Handlers run concurrently and documents are re-analysed in the background
+	mutex       sync.RWMutex
 	data        map[string]string
 	data_hash   map[string][sha256.Size]byte
 	analysis    map[string]string
 	diagnostics map[string][]LspDiagnostic
+	// Every change to the text or diagnostics of a document gets a new result id
+	resultIds    map[string]string
+	nextResultId int
+	// Tells apart the result ids of different server runs
+	resultIdPrefix string
 }
 
 func NewLspDocuments() LspDocuments {
@@ -31,10 +45,14 @@ func NewLspDocuments() LspDocuments {
 		data_hash:   make(map[string][sha256.Size]byte),
 		analysis:    make(map[string]string),
 		diagnostics: make(map[string][]LspDiagnostic),
+		resultIds:      make(map[string]string),
+		resultIdPrefix: strconv.FormatInt(time.Now().UnixNano(), 36),
 	}
 }
 
 func (d *lspDocuments) Load(uri string) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	logs.Printf("[+] Loading Document....")
 	if d.data[uri] == "" {
 		s := fmt.Sprintf("document (%s) not found", uri)
@@ -44,6 +62,8 @@ func (d *lspDocuments) Load(uri string) (string, error) {
 }
 
 func (d *lspDocuments) Store(uri string, data string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	logs.Printf("[+] Storing Document....")
 	hash := sha256.Sum256([]byte(data))
 	if d.data_hash[uri] == hash {
@@ -52,28 +72,42 @@ func (d *lspDocuments) Store(uri string, data string) error {
 
 	d.data[uri] = data
 	d.data_hash[uri] = hash
+	d.newResultId(uri)
 	return nil
 }
 
 func (d *lspDocuments) Delete(uri string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	logs.Printf("[+] Clearing content")
 	delete(d.data, uri)
 	delete(d.data_hash, uri)
+	delete(d.resultIds, uri)
 	return nil
 }
 
 func (d *lspDocuments) Dump() map[string]string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	logs.Printf("[+] Dumping data")
-	return d.data
+	data := make(map[string]string, len(d.data))
+	for uri, text := range d.data {
+		data[uri] = text
+	}
+	return data
 }
 
 func (d *lspDocuments) StoreAnalysis(uri string, analysis string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	logs.Printf("[+] Storing Analysis")
 	d.analysis[uri] = analysis
 	return nil
 }
 
 func (d *lspDocuments) LoadAnalysis(uri string) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	logs.Printf("[+] Loading Analysis....")
 	if d.analysis[uri] == "" {
 		s := fmt.Sprintf("diagnostics (%s) not found", uri)
@@ -83,6 +117,8 @@ func (d *lspDocuments) LoadAnalysis(uri string) (string, error) {
 }
 
 func (d *lspDocuments) GetDiagnostics(uri string) ([]LspDiagnostic, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	logs.Printf("[+] GetDiagnostics....")
 	if d.diagnostics[uri] == nil {
 		s := fmt.Sprintf("diagnostics (%s) not found", uri)
@@ -93,10 +129,36 @@ func (d *lspDocuments) GetDiagnostics(uri string) ([]LspDiagnostic, error) {
 }
 
 func (d *lspDocuments) UpdateDiagnostics(uri string, diagnostics []LspDiagnostic) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
     logs.Printf("[+] UpdateDiagnostics for URI: %s with %d diagnostics\n", uri, len(diagnostics))
     for _, diag := range diagnostics {
         logs.Printf("Diagnostic: Line %d, Message: %s, Severity: %s", diag.LineNumber, diag.Description, diag.Severity)
     }
     d.diagnostics[uri] = diagnostics
+	d.newResultId(uri)
     return nil
 }
+
+func (d *lspDocuments) ResultId(uri string) string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.resultIds[uri]
+}
+
+// newResultId must be called with the mutex held
+func (d *lspDocuments) newResultId(uri string) {
+	d.nextResultId += 1
+	d.resultIds[uri] = fmt.Sprintf("%s-%d", d.resultIdPrefix, d.nextResultId)
+}
+
+// ClearAnalysis forgets every analysis and diagnostic so documents are analysed again on their next update.
+func (d *lspDocuments) ClearAnalysis() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	logs.Printf("[+] Clearing analysis")
+	d.data_hash = make(map[string][sha256.Size]byte)
+	d.analysis = make(map[string]string)
+	d.diagnostics = make(map[string][]LspDiagnostic)
+	d.resultIds = make(map[string]string)
+}
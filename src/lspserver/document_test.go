@@ -0,0 +1,44 @@
+package lspserver
+
+import (
+	"testing"
+)
+
+func TestResultIds(t *testing.T) {
+	documents := NewLspDocuments()
+	uri, other := "file:///work/main.c", "file:///work/util.c"
+	if id := documents.ResultId(uri); id != "" {
+		t.Errorf("result id %q before the document was stored", id)
+	}
+
+	documents.Store(uri, "int x;\n")
+	ids := []string{documents.ResultId(uri)}
+	// Storing the same text again is no change
+	documents.Store(uri, "int x;\n")
+	if id := documents.ResultId(uri); id != ids[0] {
+		t.Errorf("same text changed the result id to %q", id)
+	}
+
+	documents.Store(uri, "int x = 1;\n")
+	ids = append(ids, documents.ResultId(uri))
+	documents.UpdateDiagnostics(uri, []LspDiagnostic{{LineNumber: 1, Rule: "Rule 8.4"}})
+	ids = append(ids, documents.ResultId(uri))
+	documents.Store(other, "int y;\n")
+	ids = append(ids, documents.ResultId(other))
+	documents.UpdateDiagnostics(uri, nil)
+	ids = append(ids, documents.ResultId(uri))
+
+	// Every change gets an id of its own, whatever document it is about
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			t.Errorf("result id %q in %q", id, ids)
+		}
+		seen[id] = true
+	}
+
+	documents.Delete(uri)
+	if id := documents.ResultId(uri); id != "" {
+		t.Errorf("result id %q after delete", id)
+	}
+}
@@ -0,0 +1,310 @@
+package lspserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// lspTestConn is the connection to the server, a socket or the pipes of a server process
+type lspTestConn interface {
+	io.ReadWriter
+	SetReadDeadline(t time.Time) error
+}
+
+// lspTestClient speaks just enough of the protocol to drive the server over a socket
+type lspTestClient struct {
+	t      *testing.T
+	conn   lspTestConn
+	reader *bufio.Reader
+	nextId int
+}
+
+type lspTestMessage struct {
+	Id     *json.RawMessage `json:"id,omitempty"`
+	Method string           `json:"method,omitempty"`
+	Params json.RawMessage  `json:"params,omitempty"`
+	Result json.RawMessage  `json:"result,omitempty"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (c *lspTestClient) send(message map[string]interface{}) {
+	message["jsonrpc"] = "2.0"
+	data, err := json.Marshal(message)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err = fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lspTestClient) request(method string, params interface{}) int {
+	c.nextId++
+	c.send(map[string]interface{}{"id": c.nextId, "method": method, "params": params})
+	return c.nextId
+}
+
+func (c *lspTestClient) notify(method string, params interface{}) {
+	c.send(map[string]interface{}{"method": method, "params": params})
+}
+
+func (c *lspTestClient) read() lspTestMessage {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, err := textproto.NewReader(c.reader).ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data := make([]byte, length)
+	if _, err = io.ReadFull(c.reader, data); err != nil {
+		c.t.Fatal(err)
+	}
+	var message lspTestMessage
+	if err = json.Unmarshal(data, &message); err != nil {
+		c.t.Fatal(err)
+	}
+	return message
+}
+
+/*
+ * waitFor reads messages until done returns true. Requests of the server are answered on the
+ * way, workspace/configuration with no settings and everything else with null.
+ */
+func (c *lspTestClient) waitFor(done func(message lspTestMessage) bool) lspTestMessage {
+	for {
+		message := c.read()
+		if message.Method != "" && message.Id != nil {
+			var result interface{}
+			if message.Method == "workspace/configuration" {
+				result = []interface{}{nil}
+			}
+			c.send(map[string]interface{}{"id": message.Id, "result": result})
+		}
+		if done(message) {
+			return message
+		}
+	}
+}
+
+// response waits for the response to the request with id
+func (c *lspTestClient) response(id int) lspTestMessage {
+	return c.waitFor(func(message lspTestMessage) bool {
+		return message.Method == "" && message.Id != nil && string(*message.Id) == strconv.Itoa(id)
+	})
+}
+
+// TestReplayEndToEnd serves a recorded analysis through the whole server, from didOpen to the
+// pulled diagnostics.
+func TestReplayEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	document := "#include <stdio.h>\n\nint main(void)\n{\n    printf(\"x\");\n    return 0;\n}\n"
+	analysis := `[{"line_number": 5, "snippet": "printf", "source": "MISRA C:2012", "rule": "Rule 17.7",` +
+		` "severity": "advisory", "description": "unused return", "recommendation": "cast to void"}]`
+
+	promptFile := writeFile(t, "prompt.txt", "You are a MISRA C linter.")
+	prompt, err := analysisPrompt(Settings{PromptFile: promptFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := json.Marshal(cassetteEntry{
+		Key:      cassetteKey(prompt, document),
+		Kind:     cassetteAnalyse,
+		Query:    document,
+		Response: analysis,
+	})
+	cassette := filepath.Join(dir, "cassette.jsonl")
+	if err = os.WriteFile(cassette, append(entry, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "lsp.sock")
+	backend, listen := "replay", "unix:"+socket
+	ParamBackend, ParamPromptFile, ParamListen = &backend, &promptFile, &listen
+	ParamBackends = map[string]json.RawMessage{"replay": json.RawMessage(`{"cassette": "` + cassette + `"}`)}
+	defer func() { ParamBackend, ParamPromptFile, ParamListen, ParamBackends = nil, nil, nil, nil }()
+
+	go func() {
+		if err := Serve("lsp-test"); err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &lspTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	capabilities := map[string]interface{}{
+		"workspace": map[string]interface{}{"diagnostics": map[string]interface{}{"refreshSupport": true}},
+	}
+	c.response(c.request("initialize", map[string]interface{}{"capabilities": capabilities}))
+	c.notify("initialized", map[string]interface{}{})
+
+	uri := "file://" + filepath.Join(dir, "main.c")
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "c", "version": 1, "text": document},
+	})
+	c.waitFor(func(message lspTestMessage) bool { return message.Method == "workspace/diagnostic/refresh" })
+
+	message := c.response(c.request("textDocument/diagnostic", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+	}))
+	if message.Error != nil {
+		t.Fatalf("textDocument/diagnostic failed: %s", message.Error.Message)
+	}
+	var report struct {
+		Kind  string `json:"kind"`
+		Items []struct {
+			Range struct {
+				Start struct {
+					Line int `json:"line"`
+				} `json:"start"`
+			} `json:"range"`
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(message.Result, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Kind != "full" || len(report.Items) != 1 {
+		t.Fatalf("unexpected report %s", message.Result)
+	}
+	item := report.Items[0]
+	if item.Range.Start.Line != 4 || item.Code != "MISRA C:2012 Rule 17.7" {
+		t.Errorf("unexpected diagnostic %+v", item)
+	}
+
+	c.response(c.request("shutdown", nil))
+	c.notify("exit", nil)
+}
+
+// serveStdioEnv makes the test binary serve over stdio instead of running the tests, see TestMain
+const serveStdioEnv = "LSP_TEST_SERVE_STDIO"
+
+// serveStdio runs the server like main does and returns the exit code of the process
+func serveStdio() int {
+	backend := "test-stub"
+	ParamBackend = &backend
+	ParamBackends = map[string]json.RawMessage{"test-stub": json.RawMessage(`{"analysis": "[]"}`)}
+	if err := Serve("lsp-test"); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// stdioConn joins the pipes of a server process, stdout is read with a deadline
+type stdioConn struct {
+	*os.File
+	stdin io.Writer
+}
+
+func (c stdioConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// startStdioServer runs the test binary as stdio server and initializes it
+func startStdioServer(t *testing.T) (*exec.Cmd, *lspTestClient) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), serveStdioEnv+"=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stdout = w
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	t.Cleanup(func() {
+		stdout.Close()
+		cmd.Process.Kill()
+	})
+
+	conn := stdioConn{File: stdout, stdin: stdin}
+	c := &lspTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.response(c.request("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}}))
+	return cmd, c
+}
+
+// exitCode waits for the server process and returns its exit code
+func exitCode(t *testing.T, cmd *exec.Cmd) int {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			t.Fatal(err)
+		}
+		return cmd.ProcessState.ExitCode()
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not exit")
+		return -1
+	}
+}
+
+func TestShutdownAndExit(t *testing.T) {
+	cmd, c := startStdioServer(t)
+	// The configuration the server pulls is answered while waiting for the shutdown response
+	c.notify("initialized", map[string]interface{}{})
+	if message := c.response(c.request("shutdown", nil)); message.Error != nil {
+		t.Fatalf("shutdown failed: %s", message.Error.Message)
+	}
+	// Only exit is handled after shutdown
+	message := c.response(c.request("textDocument/hover", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": "file:///work/main.c"},
+		"position":     map[string]interface{}{"line": 0, "character": 0},
+	}))
+	if message.Error == nil || message.Error.Code != -32600 {
+		t.Errorf("request after shutdown: %+v", message)
+	}
+	c.notify("exit", nil)
+	if code := exitCode(t, cmd); code != 0 {
+		t.Errorf("exit code %d after shutdown, want 0", code)
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	cmd, c := startStdioServer(t)
+	c.notify("exit", nil)
+	if code := exitCode(t, cmd); code != 1 {
+		t.Errorf("exit code %d without shutdown, want 1", code)
+	}
+
+	// A client going away is no shutdown either
+	cmd, c = startStdioServer(t)
+	c.conn.(stdioConn).stdin.(io.Closer).Close()
+	if code := exitCode(t, cmd); code != 1 {
+		t.Errorf("exit code %d after disconnecting, want 1", code)
+	}
+}
@@ -0,0 +1,216 @@
+package lspserver
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CFunction is a function definition found in a C document, lines are 0-based
+type CFunction struct {
+	Name      string
+	StartLine int
+	EndLine   int
+}
+
+var functionNameRe = regexp.MustCompile(`([A-Za-z_]\w*)\s*\(`)
+
+var trailingIdentifierRe = regexp.MustCompile(`([A-Za-z_]\w*)\s*$`)
+
+// A K&R signature followed by its first parameter declaration, e.g. "int add(a, b) int a"
+var knrHeaderRe = regexp.MustCompile(`^(.*\))\s*[^()=]+$`)
+
+// The identifier list of a K&R signature
+var knrParametersRe = regexp.MustCompile(`\(\s*[A-Za-z_]\w*(\s*,\s*[A-Za-z_]\w*)*\s*\)$`)
+
+// Identifiers that look like calls in a signature but never name the function
+var notFunctionNames = map[string]bool{
+	"__attribute__": true,
+	"__declspec":    true,
+	"_Alignas":      true,
+	"sizeof":        true,
+}
+
+/*
+ * FindFunctions is a lightweight function boundary detector. It does not parse C, it tracks
+ * braces while skipping comments, string and character literals and preprocessor lines, and
+ * treats every top-level block whose header looks like a signature as a function definition.
+ * K&R definitions, whose parameter declarations sit between the signature and the body, count too.
+ * @param text The document text
+ * @return functions The function definitions in document order
+ */
+func FindFunctions(text string) []CFunction {
+	var functions []CFunction
+	var header strings.Builder
+	var current CFunction
+	// K&R signature waiting for its body after the parameter declarations
+	var knr CFunction
+
+	headerLine := -1
+	depth := 0
+	line := 0
+	atLineStart := true
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case c == '\n':
+			line++
+			atLineStart = true
+			header.WriteByte(' ')
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			if depth == 0 {
+				header.WriteByte(' ')
+			}
+			continue
+		case c == '#' && atLineStart:
+			// Preprocessor directive, runs to the end of the line including continuations
+			for i+1 < len(text) && text[i+1] != '\n' {
+				if text[i+1] == '\\' && i+2 < len(text) && text[i+2] == '\n' {
+					i++
+					line++
+				}
+				i++
+			}
+			if depth == 0 {
+				header.Reset()
+				headerLine = -1
+			}
+			continue
+		case c == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i+1 < len(text) && text[i+1] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			i++
+			for i+1 < len(text) && !(text[i] == '*' && text[i+1] == '/') {
+				i++
+				if text[i] == '\n' {
+					line++
+				}
+			}
+			i++
+			continue
+		}
+
+		atLineStart = false
+
+		if c == '"' || c == '\'' {
+			start := i
+			for i+1 < len(text) && text[i+1] != c && text[i+1] != '\n' {
+				if text[i+1] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			if depth == 0 && i < len(text) {
+				header.WriteString(text[start : i+1])
+			}
+			continue
+		}
+
+		if depth > 0 {
+			switch c {
+			case '{':
+				depth++
+			case '}':
+				depth--
+				if depth == 0 {
+					if current.Name != "" {
+						current.EndLine = line
+						functions = append(functions, current)
+					}
+					current = CFunction{}
+					header.Reset()
+					headerLine = -1
+				}
+			}
+			continue
+		}
+
+		switch c {
+		case ';':
+			if knr.Name == "" {
+				if name := knrFunctionName(header.String()); name != "" {
+					knr = CFunction{Name: name, StartLine: headerLine}
+				}
+			}
+			header.Reset()
+			headerLine = -1
+		case '}':
+			knr = CFunction{}
+			header.Reset()
+			headerLine = -1
+		case '{':
+			depth = 1
+			if name := functionName(header.String()); name != "" {
+				current = CFunction{Name: name, StartLine: headerLine}
+			} else if knr.Name != "" && strings.TrimSpace(header.String()) == "" {
+				current = knr
+			}
+			knr = CFunction{}
+		default:
+			if headerLine < 0 {
+				headerLine = line
+			}
+			header.WriteByte(c)
+		}
+	}
+
+	return functions
+}
+
+// functionName returns the name of the function if header looks like a function signature
+func functionName(header string) string {
+	header = strings.TrimSpace(header)
+	if !strings.Contains(header, "(") || !strings.HasSuffix(header, ")") || strings.Contains(header, "=") {
+		return ""
+	}
+
+	// The parameter list is the last parenthesised group, the name comes right before it. This
+	// skips macros in front of the name, e.g. "EXPORT(int) init(void)".
+	depth := 0
+	for i := len(header) - 1; i >= 0; i-- {
+		if header[i] == ')' {
+			depth++
+		} else if header[i] == '(' {
+			if depth--; depth == 0 {
+				if match := trailingIdentifierRe.FindStringSubmatch(header[:i]); match != nil && !notFunctionNames[match[1]] && !cKeywords[match[1]] {
+					return match[1]
+				}
+				break
+			}
+		}
+	}
+
+	// Declarators like "(*handler(int sig))(int)" name the function in the first call
+	for _, match := range functionNameRe.FindAllStringSubmatch(header, -1) {
+		if !notFunctionNames[match[1]] && !cKeywords[match[1]] {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// knrFunctionName returns the name of the function if header is a K&R signature followed by the
+// first parameter declaration
+func knrFunctionName(header string) string {
+	match := knrHeaderRe.FindStringSubmatch(strings.TrimSpace(header))
+	if match == nil || !knrParametersRe.MatchString(match[1]) {
+		return ""
+	}
+	return functionName(match[1])
+}
+
+// FunctionAt returns the function enclosing the 0-based line, if any
+func FunctionAt(functions []CFunction, line int) (CFunction, bool) {
+	for _, f := range functions {
+		if line >= f.StartLine && line <= f.EndLine {
+			return f, true
+		}
+	}
+	return CFunction{}, false
+}
@@ -0,0 +1,122 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+func TestFindFunctions(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		text string
+		want []CFunction
+	}{
+		{"ansi", "int add(int a, int b)\n{\n    return a + b;\n}\n", []CFunction{{"add", 0, 3}}},
+		{"brace on the signature line", "static void f(void) {\n}\nvoid g(void) { }\n",
+			[]CFunction{{"f", 0, 1}, {"g", 2, 2}}},
+		{"multi-line signature", "static int\nclamp(int value,\n      int limit)\n{\n    return value;\n}\n",
+			[]CFunction{{"clamp", 0, 5}}},
+		{"k&r", "int add(a, b)\nint a;\nint b;\n{\n    return a + b;\n}\n", []CFunction{{"add", 0, 5}}},
+		{"k&r after a prototype", "int add(int, int);\nint x;\nlong sum(a, b)\nlong a, b;\n{\n    return a + b;\n}\n",
+			[]CFunction{{"sum", 2, 6}}},
+		{"macros", "#define MAX(a, b) ((a) > (b) ? (a) : (b))\n#define BODY { \\\n    return 0; }\nint f(void)\n{\n    return MAX(1, 2);\n}\n",
+			[]CFunction{{"f", 3, 6}}},
+		{"macro in the signature", "EXPORT(int) api_init(void)\n{\n    return 0;\n}\nint __attribute__((noinline)) slow(void)\n{\n}\n",
+			[]CFunction{{"api_init", 0, 3}, {"slow", 4, 6}}},
+		{"braces in strings, characters and comments",
+			"/* void fake(void) { */\nint f(void)\n{\n    const char *s = \"}\\\"{\";\n    char c = '}';\n    // }\n    /* } */\n    return 0;\n}\n",
+			[]CFunction{{"f", 1, 8}}},
+		{"no definitions", "struct point { int x; };\nint table[] = { 1, 2 };\nint f(void);\nenum { A, B };\n", nil},
+		{"function pointer result", "void (*handler(int sig))(int)\n{\n    return 0;\n}\n", []CFunction{{"handler", 0, 3}}},
+		{"nested blocks", "void f(int x)\n{\n    if (x) {\n        while (x--) { }\n    }\n}\n", []CFunction{{"f", 0, 5}}},
+	} {
+		if got := FindFunctions(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLensTitle(t *testing.T) {
+	f := CFunction{Name: "f", StartLine: 2, EndLine: 10}
+	diagnostics := []LspDiagnostic{
+		{LineNumber: 2, Severity: "advisory"},
+		{LineNumber: 3, Severity: "advisory"},
+		{LineNumber: 4, Severity: "Mandatory"},
+		{LineNumber: 5, Severity: "custom"},
+		{LineNumber: 6},
+		{LineNumber: 12, Severity: "required"},
+	}
+	if got, want := lensTitle(f, diagnostics), "1 mandatory · 1 advisory · 1 other · 1 custom"; got != want {
+		t.Errorf("lensTitle() = %q, want %q", got, want)
+	}
+	if got := lensTitle(f, diagnostics[:1]); got != "no findings" {
+		t.Errorf("lensTitle() = %q, want no findings", got)
+	}
+}
+
+func TestOnCodeLens(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession)}
+	ctx := context.Background()
+	uri := "file:///work/lens.c"
+	text := "int f(void)\n{\n    return 0;\n}\n\nint g(a)\nint a;\n{\n    return a;\n}\n"
+	params := &defines.CodeLensParams{TextDocument: defines.TextDocumentIdentifier{Uri: defines.DocumentUri(uri)}}
+
+	l.documents(ctx).Store(uri, text)
+	lenses, _ := l.OnCodeLens(ctx, params)
+	if len(*lenses) != 2 || (*lenses)[0].Command.Title != "not analysed" {
+		t.Fatalf("lenses before the analysis %+v", *lenses)
+	}
+
+	l.documents(ctx).UpdateDiagnostics(uri, []LspDiagnostic{{LineNumber: 9, Severity: "required"}})
+	lenses, _ = l.OnCodeLens(ctx, params)
+	var titles []string
+	for _, lens := range *lenses {
+		titles = append(titles, lens.Command.Title)
+	}
+	if want := []string{"no findings", "1 required"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("titles %v, want %v", titles, want)
+	}
+	second := (*lenses)[1]
+	if second.Range.Start.Line != 5 || second.Command.Command != CommandAnalyzeFunction ||
+		!reflect.DeepEqual(*second.Command.Arguments, []interface{}{uri, 5}) {
+		t.Errorf("lens of g %+v", second)
+	}
+}
+
+func TestAnalyzeFunctionDropsOutdatedResults(t *testing.T) {
+	backend := "test-stub"
+	ParamBackend = &backend
+	ParamBackends = map[string]json.RawMessage{"test-stub": json.RawMessage(`{"analysis": "[{\"line_number\": 1, \"rule\": \"Rule 8.7\"}]"}`)}
+	defer func() { ParamBackend, ParamBackends, stub.analysing = nil, nil, nil }()
+
+	l := NewLspServer("lsp-test").(*lspServer)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	uri := "file:///work/lens.c"
+	text := "int f(void)\n{\n    return 0;\n}\n"
+	documents := l.documents(ctx)
+	documents.Store(uri, text)
+
+	// A line inserted above f while it is analysed moves the function
+	stub.analysing = func() { documents.Store(uri, "\n"+text) }
+	if err := l.analyzeFunction(ctx, uri, 0); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics, err := documents.GetDiagnostics(uri); err == nil {
+		t.Errorf("outdated analysis stored %+v", diagnostics)
+	}
+
+	stub.analysing = nil
+	if err := l.analyzeFunction(ctx, uri, 1); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics, _ := documents.GetDiagnostics(uri); len(diagnostics) != 1 || diagnostics[0].LineNumber != 2 {
+		t.Errorf("diagnostics %+v", diagnostics)
+	}
+}
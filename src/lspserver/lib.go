@@ -2,6 +2,7 @@ package lspserver
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
 )
@@ -33,3 +34,16 @@ func JSONStringify(obj interface{}) (string, error) {
 	}
 	return string(bytes), nil
 }
+
+// RulesPrompt renders a rule set as an addendum to a system prompt, empty when no rules are set.
+func RulesPrompt(rules []string) string {
+	if len(rules) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\nOnly evaluate the source code against the following rules:\n")
+	for i, rule := range rules {
+		b.WriteString(fmt.Sprintf("- Rule %d: %s\n", i+1, rule))
+	}
+	return b.String()
+}
@@ -0,0 +1,19 @@
+package lspserver
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+func TestMain(m *testing.M) {
+	// The server logs through a logger set up by main, tests discard the output
+	logs.Init(log.New(io.Discard, "", 0))
+	if os.Getenv(serveStdioEnv) != "" {
+		os.Exit(serveStdio())
+	}
+	os.Exit(m.Run())
+}
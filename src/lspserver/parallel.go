@@ -0,0 +1,207 @@
+package lspserver
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultParallelRequests is how many requests a backend sends at once unless configured otherwise
+const defaultParallelRequests = 4
+
+/*
+ * requestLimiter bounds the requests a backend has in flight, across all documents and
+ * completions. It is independent of the document locks, chunks of several documents share it.
+ */
+type requestLimiter struct {
+	slots chan struct{}
+}
+
+// newRequestLimiter allows limit requests at once, defaultParallelRequests when limit is not positive
+func newRequestLimiter(limit int) *requestLimiter {
+	if limit <= 0 {
+		limit = defaultParallelRequests
+	}
+	return &requestLimiter{slots: make(chan struct{}, limit)}
+}
+
+// acquire waits for a free slot, it fails when ctx is done first
+func (l *requestLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *requestLimiter) release() {
+	<-l.slots
+}
+
+/*
+ * documentLocks serializes the analyses of a document, analyses of different documents run at
+ * the same time. The locks are dropped once nobody holds or waits for them.
+ */
+type documentLocks struct {
+	mutex sync.Mutex
+	locks map[string]*documentLock
+}
+
+type documentLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the document uri, the returned func unlocks it
+func (d *documentLocks) lock(uri string) func() {
+	d.mutex.Lock()
+	if d.locks == nil {
+		d.locks = make(map[string]*documentLock)
+	}
+	lock, ok := d.locks[uri]
+	if !ok {
+		lock = &documentLock{}
+		d.locks[uri] = lock
+	}
+	lock.users++
+	d.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if lock.users--; lock.users == 0 {
+			delete(d.locks, uri)
+		}
+	}
+}
+
+/*
+ * cancelGroup hands out request contexts and cancels all of those in flight at once, for the
+ * Cancel method of backends serving several requests at a time.
+ */
+type cancelGroup struct {
+	mutex   sync.Mutex
+	next    int
+	cancels map[int]context.CancelFunc
+}
+
+// context returns a context cancelled by ctx and by cancel, the returned func releases it
+func (g *cancelGroup) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.cancels == nil {
+		g.cancels = make(map[int]context.CancelFunc)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	id := g.next
+	g.next++
+	g.cancels[id] = cancel
+	return ctx, func() {
+		cancel()
+
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		delete(g.cancels, id)
+	}
+}
+
+// cancel aborts every request in flight
+func (g *cancelGroup) cancel() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, cancel := range g.cancels {
+		cancel()
+	}
+}
+
+// serializeFindings makes a FindingFunc safe for parallel requests, see FindingFunc
+func serializeFindings(findings FindingFunc) FindingFunc {
+	if findings == nil {
+		return nil
+	}
+	var mutex sync.Mutex
+	return func(finding LspDiagnostic) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		findings(finding)
+	}
+}
+
+/*
+ * runParallel sends the requests 0 to n-1, as many at once as the limiter allows, and returns
+ * their answers in request order whatever order they finish in. The first failure cancels the
+ * requests still running and is returned.
+ *
+ * @param ctx The context of the requests
+ * @param limiter Bounds the requests in flight
+ * @param n The number of requests
+ * @param request Sends request i
+ * @param done Called for every answer in the order they arrive, never concurrently, may be nil
+ * @return responses The answers in request order
+ */
+func runParallel(ctx context.Context, limiter *requestLimiter, n int,
+	request func(ctx context.Context, i int) (string, error),
+	done func(i int, completed int, response string)) ([]string, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	responses := make([]string, n)
+	var mutex sync.Mutex
+	var firstErr error
+	completed := 0
+
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		// Waiting for the slot here keeps the requests in order and the goroutines few
+		if err := limiter.acquire(ctx); err != nil {
+			fail(err)
+			break
+		}
+		// A slot freed by a failure may win against the cancellation
+		if err := ctx.Err(); err != nil {
+			limiter.release()
+			fail(err)
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer limiter.release()
+
+			response, err := request(ctx, i)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			responses[i] = response
+			completed++
+			if done != nil && firstErr == nil {
+				done(i, completed, response)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return responses, nil
+}
@@ -0,0 +1,94 @@
+package lspserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	limiter := newRequestLimiter(2)
+	var running, peak int32
+	var completions []int
+
+	responses, err := runParallel(context.Background(), limiter, 6,
+		func(ctx context.Context, i int) (string, error) {
+			now := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if now <= old || atomic.CompareAndSwapInt32(&peak, old, now) {
+					break
+				}
+			}
+			// Earlier requests take longer, they finish out of order
+			time.Sleep(time.Duration(6-i) * 5 * time.Millisecond)
+			return fmt.Sprint(i), nil
+		},
+		func(i int, completed int, response string) {
+			completions = append(completions, completed)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0", "1", "2", "3", "4", "5"}; !reflect.DeepEqual(responses, want) {
+		t.Errorf("responses %v, want %v", responses, want)
+	}
+	if peak != 2 {
+		t.Errorf("%d requests at once, want 2", peak)
+	}
+	if want := []int{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(completions, want) {
+		t.Errorf("completions %v, want %v", completions, want)
+	}
+
+	// The first failure cancels the requests still running
+	failure := errors.New("chunk failed")
+	var cancelled int32
+	_, err = runParallel(context.Background(), limiter, 4,
+		func(ctx context.Context, i int) (string, error) {
+			if i == 0 {
+				return "", failure
+			}
+			<-ctx.Done()
+			atomic.AddInt32(&cancelled, 1)
+			return "", ctx.Err()
+		}, nil)
+	if err != failure {
+		t.Errorf("runParallel() = %v, want the failure", err)
+	}
+	if len(limiter.slots) != 0 {
+		t.Errorf("%d slots still taken", len(limiter.slots))
+	}
+	if cancelled > 1 {
+		t.Errorf("%d requests started after the failure", cancelled)
+	}
+}
+
+func TestDocumentLocks(t *testing.T) {
+	var locks documentLocks
+	unlock := locks.lock("file:///a.c")
+
+	// Other documents are not held up
+	locks.lock("file:///b.c")()
+
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("file:///a.c")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("document locked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left", len(locks.locks))
+	}
+}
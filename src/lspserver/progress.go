@@ -0,0 +1,119 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+/*
+ * ProgressFunc is handed to the backends so they can report how far a long running analysis
+ * got. A nil ProgressFunc is valid and discards all reports.
+ */
+type ProgressFunc func(done int, total int, message string)
+
+func (p ProgressFunc) Report(done int, total int, message string) {
+	if p != nil {
+		p(done, total, message)
+	}
+}
+
+// noProgressKey marks contexts whose work is reported by an enclosing progress
+type noProgressKey struct{}
+
+// withoutProgress returns a context for which beginProgress reports nothing
+func withoutProgress(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noProgressKey{}, true)
+}
+
+var progressTokens struct {
+	sync.Mutex
+	next int
+}
+
+/*
+ * workDoneProgress wraps a single window/workDoneProgress token. Every method is a no-op when
+ * the client does not support server initiated progress, so callers never need to check.
+ */
+type workDoneProgress struct {
+	mutex   sync.Mutex
+	session *jsonrpc.Session
+	token   defines.ProgressToken
+	percent uint
+}
+
+/*
+ * beginProgress starts a work done progress for the session behind ctx. The client provided
+ * token is used when there is one, otherwise a token is created with window/workDoneProgress/create
+ * if the client supports it.
+ *
+ * @param ctx The context of the request that started the work.
+ * @param token The workDoneToken sent by the client, may be nil.
+ * @param title The title shown by the client.
+ * @return progress The progress, never nil.
+ */
+func (l *lspServer) beginProgress(ctx context.Context, token *defines.ProgressToken, title string) *workDoneProgress {
+	p := &workDoneProgress{session: jsonrpc.SessionFromContext(ctx)}
+	if p.session == nil || ctx.Value(noProgressKey{}) != nil {
+		p.session = nil
+		return p
+	}
+
+	if token != nil {
+		p.token = *token
+	} else if !l.session(ctx).getCapabilities().workDoneProgress {
+		p.session = nil
+		return p
+	} else {
+		progressTokens.Lock()
+		progressTokens.next += 1
+		p.token = fmt.Sprintf("llmlint-%d", progressTokens.next)
+		progressTokens.Unlock()
+
+		params := defines.WorkDoneProgressCreateParams{Token: p.token}
+		if err := p.session.Call(ctx, "window/workDoneProgress/create", params, nil); err != nil {
+			logs.Printf("window/workDoneProgress/create failed: %v", err)
+			p.session = nil
+			return p
+		}
+	}
+
+	percent := uint(0)
+	p.notify(defines.WorkDoneProgressBegin{Kind: "begin", Title: title, Percentage: &percent})
+	return p
+}
+
+// Report sends a progress report, it matches ProgressFunc so it can be handed to the backends.
+func (p *workDoneProgress) Report(done int, total int, message string) {
+	var percent uint
+	if total > 0 {
+		percent = uint(done * 100 / total)
+	}
+
+	p.mutex.Lock()
+	// Percentages must never go backwards, retries restart the backend count
+	if percent < p.percent {
+		percent = p.percent
+	}
+	p.percent = percent
+	p.mutex.Unlock()
+
+	p.notify(defines.WorkDoneProgressReport{Kind: "report", Message: &message, Percentage: &percent})
+}
+
+func (p *workDoneProgress) End(message string) {
+	p.notify(defines.WorkDoneProgressEnd{Kind: "end", Message: &message})
+}
+
+func (p *workDoneProgress) notify(value interface{}) {
+	if p.session == nil {
+		return
+	}
+	if err := p.session.Progress(p.token, value); err != nil {
+		logs.Printf("$/progress failed: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package lspserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// progressValue is the value of a $/progress notification
+type progressValue struct {
+	Token json.RawMessage `json:"token"`
+	Value struct {
+		Kind       string `json:"kind"`
+		Title      string `json:"title"`
+		Message    string `json:"message"`
+		Percentage *uint  `json:"percentage"`
+	} `json:"value"`
+}
+
+// readProgress reads the next message, which has to be a $/progress notification
+func readProgress(t *testing.T, client *lspTestClient) progressValue {
+	message := client.read()
+	var progress progressValue
+	if message.Method != "$/progress" || json.Unmarshal(message.Params, &progress) != nil {
+		t.Fatalf("got %s %s, want $/progress", message.Method, message.Params)
+	}
+	return progress
+}
+
+func TestBeginProgress(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession)}
+	server, contexts := newSessionServer(l)
+	ctx, conn := connectSession(t, server, contexts)
+	defer conn.Close()
+	client := &lspTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	// Nothing is sent while the client lacks the capability or an enclosing progress reports the
+	// work, the first message read is the progress of the client token
+	token := defines.ProgressToken("client-1")
+	go func() {
+		for _, p := range []*workDoneProgress{
+			l.beginProgress(ctx, nil, "no capability"),
+			l.beginProgress(withoutProgress(ctx), nil, "without progress"),
+		} {
+			p.Report(1, 2, "half")
+			p.End("done")
+		}
+		l.session(ctx).capabilities = clientCapabilities{workDoneProgress: true}
+		p := l.beginProgress(withoutProgress(ctx), nil, "enclosed")
+		p.Report(1, 2, "half")
+		p.End("done")
+
+		// A client token is used as is
+		p = l.beginProgress(ctx, &token, "client token")
+		p.Report(1, 4, "quarter")
+		p.Report(0, 4, "retry")
+		p.End("done")
+	}()
+	if progress := readProgress(t, client); string(progress.Token) != `"client-1"` ||
+		progress.Value.Kind != "begin" || progress.Value.Title != "client token" {
+		t.Errorf("begin %+v", progress)
+	}
+	// Percentages never go backwards
+	for _, want := range []uint{25, 25} {
+		if progress := readProgress(t, client); progress.Value.Kind != "report" || *progress.Value.Percentage != want {
+			t.Errorf("report %+v, want %d%%", progress, want)
+		}
+	}
+	if progress := readProgress(t, client); progress.Value.Kind != "end" || progress.Value.Message != "done" {
+		t.Errorf("end %+v", progress)
+	}
+
+	// Without a client token the server creates one
+	go func() {
+		l.beginProgress(ctx, nil, "server token").End("done")
+	}()
+	request := client.read()
+	var params defines.WorkDoneProgressCreateParams
+	json.Unmarshal(request.Params, &params)
+	if request.Method != "window/workDoneProgress/create" {
+		t.Fatalf("got %s, want window/workDoneProgress/create", request.Method)
+	}
+	client.send(map[string]interface{}{"id": request.Id, "result": nil})
+	created, _ := json.Marshal(params.Token)
+	if progress := readProgress(t, client); string(progress.Token) != string(created) || progress.Value.Kind != "begin" {
+		t.Errorf("begin %+v, want token %s", progress, created)
+	}
+	if progress := readProgress(t, client); progress.Value.Kind != "end" {
+		t.Errorf("end %+v", progress)
+	}
+}
@@ -0,0 +1,282 @@
+package lspserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// ErrBackendUnavailable is returned without contacting the backend while its circuit is open
+var ErrBackendUnavailable = errors.New("backend unavailable")
+
+// Attempts per request, backoff bounds and when the circuit opens
+const (
+	retryAttempts    = 4
+	retryBaseDelay   = 500 * time.Millisecond
+	retryMaxDelay    = 30 * time.Second
+	breakerThreshold = 3
+	breakerCooldown  = 30 * time.Second
+)
+
+/*
+ * backendRetrier retries the transient failures of a backend, i.e. connection errors and the
+ * 429, 502, 503 and 504 responses, with exponential backoff and full jitter. A Retry-After
+ * header takes precedence over the backoff. Once breakerThreshold requests in a row failed
+ * after all their retries the circuit opens: for breakerCooldown every request fails right away
+ * with ErrBackendUnavailable. After that a single request is let through as probe while the
+ * others keep failing: its success closes the circuit, its failure opens it for another
+ * breakerCooldown.
+ *
+ * Backends talking HTTP themselves use it as transport, see retryTransport, others wrap their
+ * calls with do.
+ */
+type backendRetrier struct {
+	name      string
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	// Whether the probe of an open circuit is in flight
+	probing bool
+	// Replaced by tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newBackendRetrier(name string) *backendRetrier {
+	return &backendRetrier{name: name, sleep: sleepContext}
+}
+
+// sleepContext waits for d, returning early with the context error once ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backoff returns the delay before the given retry, 1 for the first one
+func backoff(retry int) time.Duration {
+	limit := retryBaseDelay << (retry - 1)
+	if limit <= 0 || limit > retryMaxDelay {
+		limit = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// retryAfter parses a Retry-After header, seconds or an HTTP date, zero when absent or invalid
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// retryableStatus tells whether a response status is worth another attempt
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// transientError tells whether err is a connection failure worth another attempt
+func transientError(err error) bool {
+	if err == nil || errors.Is(err, ErrBackendUnavailable) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	// Every network failure is an *net.OpError, *url.Error also wraps invalid requests
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// canceled tells whether err ended a request the caller gave up on, it says nothing about the backend
+func canceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+/*
+ * allow fails while the circuit is open. Once the cooldown is over the first request is the
+ * probe, the circuit stays open for the others until the probe is recorded.
+ *
+ * @return probe Whether the request is the probe, it is passed to record or abandon
+ * @return error ErrBackendUnavailable while the circuit is open
+ */
+func (r *backendRetrier) allow() (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.failures < breakerThreshold {
+		return false, nil
+	}
+	if wait := time.Until(r.openUntil); wait > 0 {
+		return false, fmt.Errorf("%w: %s failed %d times in a row, retrying in %s", ErrBackendUnavailable,
+			r.name, r.failures, wait.Round(time.Second))
+	}
+	if r.probing {
+		return false, fmt.Errorf("%w: %s failed %d times in a row, waiting for a probe", ErrBackendUnavailable,
+			r.name, r.failures)
+	}
+	r.probing = true
+	return true, nil
+}
+
+// abandon ends a request that tells nothing about the backend, e.g. a cancelled one. An
+// abandoned probe lets the next request probe.
+func (r *backendRetrier) abandon(probe bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if probe {
+		r.probing = false
+	}
+}
+
+// record counts a request whose retries are done, transient tells whether it failed for good
+func (r *backendRetrier) record(probe bool, transient bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if probe {
+		r.probing = false
+	}
+	if !transient {
+		r.failures = 0
+		r.openUntil = time.Time{}
+		return
+	}
+	r.failures++
+	if r.failures >= breakerThreshold {
+		logs.Printf("%s failed %d times in a row, pausing requests for %s", r.name, r.failures, breakerCooldown)
+		r.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+/*
+ * do calls call until it succeeds, fails with an error that is not transient or runs out of
+ * attempts. Calls that must not be repeated, e.g. because part of a streamed answer was
+ * already used, return their error wrapped by finalError.
+ *
+ * @param ctx Cancels the waits between the attempts
+ * @param call The request to the backend
+ * @return error The error of the last attempt
+ */
+func (r *backendRetrier) do(ctx context.Context, call func() error) error {
+	probe, err := r.allow()
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = call()
+		var final *finalError
+		if errors.As(err, &final) {
+			err = final.err
+			break
+		}
+		if !transientError(err) || attempt == retryAttempts {
+			break
+		}
+		delay := backoff(attempt)
+		logs.Printf("%s attempt %d/%d failed: %v, retrying in %s", r.name, attempt, retryAttempts, err, delay)
+		if sleepErr := r.sleep(ctx, delay); sleepErr != nil {
+			r.abandon(probe)
+			return sleepErr
+		}
+	}
+	if canceled(err) {
+		r.abandon(probe)
+	} else {
+		r.record(probe, transientError(err))
+	}
+	return err
+}
+
+// finalError stops the retries of backendRetrier.do
+type finalError struct {
+	err error
+}
+
+func (e *finalError) Error() string { return e.err.Error() }
+func (e *finalError) Unwrap() error { return e.err }
+
+// retryTransport retries requests at the HTTP level, only there the status and Retry-After are known
+type retryTransport struct {
+	retrier *backendRetrier
+	base    http.RoundTripper
+}
+
+// newRetryClient returns an HTTP client retrying through r
+func newRetryClient(r *backendRetrier) *http.Client {
+	return &http.Client{Transport: &retryTransport{retrier: r, base: http.DefaultTransport}}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	probe, err := t.retrier.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			req = req.Clone(req.Context())
+			if req.Body, err = req.GetBody(); err != nil {
+				t.retrier.abandon(probe)
+				return nil, err
+			}
+		}
+
+		resp, err = t.base.RoundTrip(req)
+		transient := transientError(err) || err == nil && retryableStatus(resp.StatusCode)
+		// Bodies that cannot be sent again end the retries as well
+		if !transient || attempt == retryAttempts || req.Body != nil && req.GetBody == nil {
+			if canceled(err) {
+				t.retrier.abandon(probe)
+			} else {
+				t.retrier.record(probe, transient)
+			}
+			return resp, err
+		}
+
+		delay := backoff(attempt)
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+			if after := retryAfter(resp.Header.Get("Retry-After")); after > 0 {
+				delay = min(after, retryMaxDelay)
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBodyLength))
+			resp.Body.Close()
+		}
+		logs.Printf("%s attempt %d/%d failed: %s, retrying in %s", t.retrier.name, attempt, retryAttempts, reason, delay)
+		if err = t.retrier.sleep(req.Context(), delay); err != nil {
+			t.retrier.abandon(probe)
+			return nil, err
+		}
+	}
+}
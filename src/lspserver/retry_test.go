@@ -0,0 +1,205 @@
+package lspserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRetrier records the delays instead of sleeping
+func newTestRetrier(delays *[]time.Duration) *backendRetrier {
+	r := newBackendRetrier("test backend")
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	return r
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if body, _ := io.ReadAll(r.Body); string(body) != "query" {
+			t.Errorf("attempt %d sent %q", requests, body)
+		}
+		if requests < 3 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	var delays []time.Duration
+	client := newRetryClient(newTestRetrier(&delays))
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || requests != 3 {
+		t.Errorf("status %d after %d requests", resp.StatusCode, requests)
+	}
+	if len(delays) != 2 || delays[0] != 7*time.Second || delays[1] != 7*time.Second {
+		t.Errorf("delays = %v, want Retry-After twice", delays)
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	var delays []time.Duration
+	client := newRetryClient(newTestRetrier(&delays))
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || requests != retryAttempts {
+		t.Errorf("status %d after %d requests", resp.StatusCode, requests)
+	}
+	for i, d := range delays {
+		if limit := retryBaseDelay << i; d < 0 || d > limit {
+			t.Errorf("delay %d = %s, want at most %s", i+1, d, limit)
+		}
+	}
+
+	// Client errors are the caller's fault, they are neither retried nor break the circuit
+	requests = 0
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	if resp, err = client.Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if requests != 1 {
+		t.Errorf("401 sent %d times", requests)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	// Nothing listens on a closed listener's address, every attempt is refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+	listener.Close()
+
+	var delays []time.Duration
+	retrier := newTestRetrier(&delays)
+	client := newRetryClient(retrier)
+	for i := 0; i < breakerThreshold; i++ {
+		if _, err = client.Get(url); err == nil || errors.Is(err, ErrBackendUnavailable) {
+			t.Fatalf("request %d: %v, want connection error", i+1, err)
+		}
+	}
+	if len(delays) != breakerThreshold*(retryAttempts-1) {
+		t.Errorf("%d retries, want %d", len(delays), breakerThreshold*(retryAttempts-1))
+	}
+
+	delays = nil
+	if _, err = client.Get(url); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("open circuit: %v, want ErrBackendUnavailable", err)
+	}
+	calls := 0
+	if err = retrier.do(context.Background(), func() error { calls++; return nil }); !errors.Is(err, ErrBackendUnavailable) || calls != 0 {
+		t.Errorf("do() with open circuit = %v after %d calls", err, calls)
+	}
+	if len(delays) != 0 {
+		t.Errorf("open circuit waited %v", delays)
+	}
+
+	// Once the cooldown is over a single probe gets through, its failure opens the circuit again
+	retrier.openUntil = time.Now()
+	probe, err := retrier.allow()
+	if !probe || err != nil {
+		t.Fatalf("allow() after cooldown = %v, %v, want the probe", probe, err)
+	}
+	if second, err := retrier.allow(); second || !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("allow() while probing = %v, %v", second, err)
+	}
+	retrier.record(probe, true)
+	if probe, err = retrier.allow(); probe || !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("allow() after a failed probe = %v, %v", probe, err)
+	}
+
+	// An abandoned probe lets the next request probe
+	retrier.openUntil = time.Now()
+	probe, _ = retrier.allow()
+	retrier.abandon(probe)
+	if probe, err = retrier.allow(); !probe || err != nil {
+		t.Errorf("allow() after an abandoned probe = %v, %v", probe, err)
+	}
+	retrier.abandon(probe)
+
+	// A successful probe closes the circuit
+	if err = retrier.do(context.Background(), func() error { return nil }); err != nil {
+		t.Errorf("do() after cooldown = %v", err)
+	}
+	if probe, err = retrier.allow(); retrier.failures != 0 || probe || err != nil {
+		t.Errorf("circuit still open after success")
+	}
+}
+
+func TestRetrierDo(t *testing.T) {
+	var delays []time.Duration
+	retrier := newTestRetrier(&delays)
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	calls := 0
+	err := retrier.do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return reset
+		}
+		return nil
+	})
+	if err != nil || calls != 3 || len(delays) != 2 {
+		t.Errorf("do() = %v after %d calls and %d waits", err, calls, len(delays))
+	}
+
+	// Partly streamed answers are not repeated
+	calls = 0
+	err = retrier.do(context.Background(), func() error {
+		calls++
+		return &finalError{reset}
+	})
+	if err != reset || calls != 1 {
+		t.Errorf("do() = %v after %d calls, want the final error at once", err, calls)
+	}
+
+	// Cancellation ends the waits
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = retrier.do(ctx, func() error { return reset }); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled do() = %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter("120"); d != 2*time.Minute {
+		t.Errorf("seconds: %s", d)
+	}
+	if d := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d <= 0 || d > time.Minute {
+		t.Errorf("date: %s", d)
+	}
+	if d := retryAfter("soon"); d != 0 {
+		t.Errorf("invalid: %s", d)
+	}
+}
@@ -0,0 +1,282 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+/*
+ * Route sends the documents it matches to another backend, model, prompt or rule set than the
+ * settings, e.g. C files to a MISRA tuned model and Python files to a general one. A route
+ * matches when all its set conditions do, fields left empty keep the value of the settings.
+ */
+type Route struct {
+	// languageId sent by the client when opening the document, e.g. "c" or "python". Documents
+	// the client did not open get the languageId of their extension, see extensionLanguages.
+	Language string `json:"language,omitempty"`
+	// Glob matched against the file path, patterns without a slash only against the file name,
+	// e.g. "*.py", "src/**/*.c"
+	Pattern    string   `json:"pattern,omitempty"`
+	Backend    string   `json:"backend,omitempty"`
+	Model      string   `json:"model,omitempty"`
+	PromptFile string   `json:"prompt_file,omitempty"`
+	Rules      []string `json:"rules,omitempty"`
+}
+
+// extensionLanguages are the languageIds clients usually open files with, by extension
+var extensionLanguages = map[string]string{
+	".c":    "c",
+	".h":    "c",
+	".cc":   "cpp",
+	".cpp":  "cpp",
+	".cxx":  "cpp",
+	".hh":   "cpp",
+	".hpp":  "cpp",
+	".hxx":  "cpp",
+	".cs":   "csharp",
+	".go":   "go",
+	".java": "java",
+	".js":   "javascript",
+	".ts":   "typescript",
+	".py":   "python",
+	".rs":   "rust",
+	".sh":   "shellscript",
+}
+
+// documentLanguage returns the languageId of a document, derived from its extension when the
+// client did not open it
+func documentLanguage(uri string, languageId string) string {
+	if languageId != "" {
+		return languageId
+	}
+	return extensionLanguages[strings.ToLower(path.Ext(uri))]
+}
+
+// matches tells whether the document uri with the given languageId takes this route
+func (r Route) matches(uri string, languageId string) bool {
+	if r.Language == "" && r.Pattern == "" {
+		return false
+	}
+	if r.Language != "" && !strings.EqualFold(r.Language, documentLanguage(uri, languageId)) {
+		return false
+	}
+	if r.Pattern == "" {
+		return true
+	}
+	file, err := ConvertFileURIToPath(uri)
+	return err == nil && globMatch(r.Pattern, file)
+}
+
+/*
+ * globMatch matches a file path against a glob of path.Match. Patterns without a slash match the
+ * file name, others the end of the path, where "**" stands for any number of directories.
+ */
+func globMatch(pattern string, file string) bool {
+	file = strings.ReplaceAll(file, "\\", "/")
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(file))
+		return ok
+	}
+
+	parts := strings.Split(strings.TrimPrefix(file, "/"), "/")
+	var match func(pattern []string, parts []string) bool
+	match = func(pattern []string, parts []string) bool {
+		if len(pattern) == 0 {
+			return len(parts) == 0
+		}
+		if pattern[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if match(pattern[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		ok, _ := path.Match(pattern[0], parts[0])
+		return ok && match(pattern[1:], parts[1:])
+	}
+	// Relative patterns may start in any directory
+	patternParts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for i := 0; i < len(parts); i++ {
+		if match(patternParts, parts[i:]) {
+			return true
+		}
+		if strings.HasPrefix(pattern, "/") {
+			break
+		}
+	}
+	return false
+}
+
+/*
+ * route returns the settings for a document, those of the first matching route applied on top
+ * of s. Documents no route matches get s itself.
+ *
+ * @param uri The document URI
+ * @param languageId The languageId of the document, empty when the client did not open it
+ * @return settings The settings of the document
+ * @return routed Whether a route matched
+ */
+func (s Settings) route(uri string, languageId string) (Settings, bool) {
+	for _, r := range s.Routes {
+		if r.matches(uri, languageId) {
+			return s.Merge(Settings{Backend: r.Backend, Model: r.Model, PromptFile: r.PromptFile, Rules: r.Rules}), true
+		}
+	}
+	return s, false
+}
+
+/*
+ * backendPool holds the backends of the routes, created on first use and shared by all routes
+ * with the same effective settings, so every model gets a single client. It is replaced with the
+ * settings.
+ */
+type backendPool struct {
+	mutex    sync.Mutex
+	backends map[string]*pooledBackend
+}
+
+// pooledBackend is a backend of the pool, done is closed once it started or failed to
+type pooledBackend struct {
+	done    chan struct{}
+	backend LspBackend
+	err     error
+}
+
+func newBackendPool() *backendPool {
+	return &backendPool{backends: make(map[string]*pooledBackend)}
+}
+
+// backendKey identifies the backend settings create, routes to the same model share it
+func backendKey(settings Settings) (string, error) {
+	settings.Routes = nil
+	key, err := json.Marshal(settings)
+	return string(key), err
+}
+
+/*
+ * get returns the started backend of settings, starting it when this is its first use. Starting
+ * may take a while, e.g. to connect, so it runs outside the lock: only the callers of the same
+ * backend wait for it. Backends that failed to start are tried again on the next use.
+ */
+func (p *backendPool) get(settings Settings) (LspBackend, error) {
+	key, err := backendKey(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	pooled, ok := p.backends[key]
+	if !ok {
+		pooled = &pooledBackend{done: make(chan struct{})}
+		p.backends[key] = pooled
+	}
+	p.mutex.Unlock()
+	if ok {
+		<-pooled.done
+		return pooled.backend, pooled.err
+	}
+
+	logs.Printf("Starting %s backend with model %q for routed documents", settings.Backend, settings.Model)
+	backend, err := newBackend(settings)
+	if err == nil {
+		err = backend.Start()
+	}
+	if err != nil {
+		pooled.err = fmt.Errorf("routed backend %s: %w", settings.Backend, err)
+		p.mutex.Lock()
+		delete(p.backends, key)
+		p.mutex.Unlock()
+	} else {
+		pooled.backend = backend
+	}
+	close(pooled.done)
+	return pooled.backend, pooled.err
+}
+
+// all returns the backends started so far
+func (p *backendPool) all() []LspBackend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	backends := make([]LspBackend, 0, len(p.backends))
+	for _, pooled := range p.backends {
+		select {
+		case <-pooled.done:
+			if pooled.backend != nil {
+				backends = append(backends, pooled.backend)
+			}
+		default:
+			// Still starting
+		}
+	}
+	return backends
+}
+
+// Close closes the backends that need it, see lspBackendRecord
+func (p *backendPool) Close() error {
+	var err error
+	for _, backend := range p.all() {
+		if closer, ok := backend.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+/*
+ * documentBackend returns the backend analysing a document and the settings it runs with,
+ * routed documents get the backend of their route.
+ *
+ * @param ctx The context of the request, the client's languageId of the document is looked up,
+ *            see documentLanguage for documents the client did not open
+ * @param uri The document URI
+ * @return backend The backend for the document
+ * @return settings The settings of the document, see Settings.route
+ * @return error Any error that occurred while starting the backend of the route
+ */
+func (l *lspServer) documentBackend(ctx context.Context, uri string) (LspBackend, Settings, error) {
+	l.mutex.RLock()
+	backend, settings, pool := l.backend, l.settings, l.routes
+	l.mutex.RUnlock()
+
+	routed, ok := settings.route(uri, l.session(ctx).getLanguage(uri))
+	if !ok || routed.Equal(settings) {
+		return backend, settings, nil
+	}
+	backend, err := pool.get(routed)
+	return backend, routed, err
+}
+
+// cacheText is what the analysis of a document is cached under, the text prefixed with the
+// backend of its route so routes do not share analyses
+func (l *lspServer) cacheText(ctx context.Context, uri string, text string) string {
+	settings := l.getSettings()
+	routed, ok := settings.route(uri, l.session(ctx).getLanguage(uri))
+	if !ok || routed.Equal(settings) {
+		return text
+	}
+	key, err := backendKey(routed)
+	if err != nil {
+		return text
+	}
+	return key + "\n" + text
+}
+
+// allBackends returns the backend of the settings and those of the routes started so far
+func (l *lspServer) allBackends() []LspBackend {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return append([]LspBackend{l.backend}, l.routes.all()...)
+}
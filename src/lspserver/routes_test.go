@@ -0,0 +1,184 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		file    string
+		want    bool
+	}{
+		{"*.py", "/home/me/project/tool.py", true},
+		{"*.py", "/home/me/project/tool.c", false},
+		{"*.[ch]", "/home/me/project/src/main.h", true},
+		{"src/*.c", "/home/me/project/src/main.c", true},
+		{"src/*.c", "/home/me/project/src/drivers/uart.c", false},
+		{"src/**/*.c", "/home/me/project/src/drivers/uart.c", true},
+		{"src/**/*.c", "/home/me/project/src/main.c", true},
+		{"/home/**/test_*.py", "/home/me/project/test_tool.py", true},
+		{"/project/*.c", "/home/me/project/main.c", false},
+		{"C:/work/**/*.c", "C:\\work\\src\\main.c", true},
+	} {
+		if got := globMatch(test.pattern, test.file); got != test.want {
+			t.Errorf("globMatch(%q, %q) = %v", test.pattern, test.file, got)
+		}
+	}
+}
+
+func TestSettingsRoute(t *testing.T) {
+	settings := Settings{
+		Backend: "ollama",
+		Model:   "misra-coder",
+		Rules:   []string{"MISRA"},
+		Routes: []Route{
+			{Language: "python", Model: "deepseek-coder", Rules: []string{"PEP 8"}},
+			{Pattern: "*.py", Backend: "openai"},
+			{Language: "c", Pattern: "test/**/*.c", PromptFile: "tests.txt"},
+		},
+	}
+
+	routed, ok := settings.route("file:///work/tool.py", "python")
+	if !ok || routed.Backend != "ollama" || routed.Model != "deepseek-coder" || routed.Rules[0] != "PEP 8" {
+		t.Errorf("python: %v %+v", ok, routed)
+	}
+	// Files the client did not open get the languageId of their extension
+	if routed, ok = settings.route("file:///work/tool.py", ""); !ok || routed.Model != "deepseek-coder" {
+		t.Errorf("unopened .py: %v %+v", ok, routed)
+	}
+	if routed, ok = settings.route("file:///work/test/unit/main.c", ""); !ok || routed.PromptFile != "tests.txt" {
+		t.Errorf("unopened test file: %v %+v", ok, routed)
+	}
+	// The languageId decides before the extension, the first match wins
+	if routed, ok = settings.route("file:///work/tool.py", "plaintext"); !ok || routed.Backend != "openai" || routed.Model != "misra-coder" {
+		t.Errorf("plain text .py: %v %+v", ok, routed)
+	}
+	// Every condition of a route has to match
+	if routed, ok = settings.route("file:///work/test/unit/main.c", "c"); !ok || routed.PromptFile != "tests.txt" {
+		t.Errorf("test file: %v %+v", ok, routed)
+	}
+	if _, ok = settings.route("file:///work/src/main.c", "c"); ok {
+		t.Errorf("main.c took a route")
+	}
+}
+
+func TestBackendPool(t *testing.T) {
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+	if err := os.WriteFile(cassette, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := json.Marshal(ReplayConfig{Cassette: cassette})
+	settings := Settings{Backend: "replay", Backends: map[string]json.RawMessage{"replay": config}}
+
+	pool := newBackendPool()
+	first, err := pool.get(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Routes to the same model share the backend whatever routes brought them there
+	settings.Routes = []Route{{Language: "c"}}
+	if second, _ := pool.get(settings); second != first {
+		t.Errorf("same settings got another backend")
+	}
+	settings.Model = "other"
+	if third, _ := pool.get(settings); third == first {
+		t.Errorf("another model got the same backend")
+	}
+	if len(pool.all()) != 2 {
+		t.Errorf("%d backends, want 2", len(pool.all()))
+	}
+
+	settings.Backend = "nonexistent"
+	if _, err = pool.get(settings); err == nil {
+		t.Errorf("invalid backend started")
+	}
+}
+
+// blockingBackend starts once started is closed
+type blockingBackend struct {
+	stubBackend
+	started chan struct{}
+}
+
+func (b *blockingBackend) Start() error {
+	<-b.started
+	return nil
+}
+
+var blocking = &blockingBackend{}
+
+func init() {
+	RegisterBackend("test-blocking", "starts once the test lets it", func(settings Settings, config struct{}) (LspBackend, error) {
+		return blocking, nil
+	})
+}
+
+func TestBackendPoolStartsOutsideLock(t *testing.T) {
+	blocking.started = make(chan struct{})
+	pool := newBackendPool()
+	slow := Settings{Backend: "test-blocking"}
+	results := make(chan LspBackend, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			backend, _ := pool.get(slow)
+			results <- backend
+		}()
+	}
+
+	// Other backends start while the slow one is starting, and all skips it
+	fast := Settings{Backend: "test-stub", Backends: map[string]json.RawMessage{"test-stub": json.RawMessage(`{}`)}}
+	if backend, err := pool.get(fast); err != nil || backend != stub {
+		t.Fatalf("stub backend %v, %v", backend, err)
+	}
+	if backends := pool.all(); len(backends) != 1 {
+		t.Errorf("%d backends while starting, want 1", len(backends))
+	}
+
+	close(blocking.started)
+	for i := 0; i < 2; i++ {
+		select {
+		case backend := <-results:
+			if backend != blocking {
+				t.Errorf("got %v, want the started backend", backend)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("backend not started")
+		}
+	}
+	if len(pool.all()) != 2 {
+		t.Errorf("%d backends, want 2", len(pool.all()))
+	}
+}
+
+func TestAnalyzeFileRoutedDocument(t *testing.T) {
+	backend := "test-stub"
+	ParamBackend = &backend
+	ParamRoutes = []Route{{Pattern: "*.c", Model: "routed"}}
+	ParamBackends = map[string]json.RawMessage{"test-stub": json.RawMessage(`{"analysis": "[{\"line_number\": 1, \"rule\": \"Rule 8.7\"}]"}`)}
+	defer func() { ParamBackend, ParamRoutes, ParamBackends = nil, nil, nil }()
+
+	l := NewLspServer("lsp-test").(*lspServer)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	uri, text := "file:///work/main.c", "int x;\n"
+	l.documents(ctx).Store(uri, text)
+	l.cache.Store(l.cacheText(ctx, uri, text), "[]", []LspDiagnostic{{LineNumber: 1, Rule: "stale"}})
+
+	// The command analyses again instead of answering from the cache of the route
+	calls := stub.calls
+	if err := l.analyzeFile(ctx, uri); err != nil {
+		t.Fatal(err)
+	}
+	diagnostics, _ := l.documents(ctx).GetDiagnostics(uri)
+	if stub.calls != calls+1 || len(diagnostics) != 1 || diagnostics[0].Rule != "Rule 8.7" {
+		t.Errorf("%d backend calls, diagnostics %+v", stub.calls-calls, diagnostics)
+	}
+}
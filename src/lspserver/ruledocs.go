@@ -0,0 +1,51 @@
+package lspserver
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// defaultRuleDocs is the RuleDocs key used for sources without their own template
+const defaultRuleDocs = "*"
+
+var ruleIdRe = regexp.MustCompile(`\d+(\.\d+)*`)
+
+/*
+ * RuleDocs maps a finding source, e.g. "MISRA C:2012", to the URL template of its rule
+ * documentation. Templates may use the placeholders
+ *   {source}  the source, e.g. "MISRA C:2012"
+ *   {rule}    the rule as reported, e.g. "Rule 17.7"
+ *   {rule_id} the rule number, e.g. "17.7"
+ * for example "https://wiki.example.com/misra/{rule_id}" or "file:///opt/misra/rule-{rule_id}.html".
+ * The "*" entry applies to every source without an entry of its own.
+ */
+type RuleDocs map[string]string
+
+// URL returns the documentation URL of a rule, empty when no template applies
+func (r RuleDocs) URL(source string, rule string) string {
+	template := ""
+	for key, t := range r {
+		if ruleCatalogKey(key, "") == ruleCatalogKey(source, "") {
+			template = t
+			break
+		}
+	}
+	if template == "" {
+		template = r[defaultRuleDocs]
+	}
+	if template == "" {
+		return ""
+	}
+
+	ruleId := ruleIdRe.FindString(rule)
+	if ruleId == "" {
+		ruleId = strings.Join(strings.Fields(rule), "")
+	}
+
+	return strings.NewReplacer(
+		"{source}", url.PathEscape(source),
+		"{rule}", url.PathEscape(rule),
+		"{rule_id}", url.PathEscape(ruleId),
+	).Replace(template)
+}
@@ -0,0 +1,39 @@
+package lspserver
+
+import (
+	"testing"
+)
+
+func TestRuleDocsURL(t *testing.T) {
+	docs := RuleDocs{
+		"MISRA C:2012": "https://wiki.example.com/misra/{rule_id}",
+		"CERT C":       "https://cert.example.com/{source}/{rule}",
+		"*":            "file:///opt/rules/{source}-{rule_id}.html",
+	}
+	for _, test := range []struct {
+		source, rule string
+		want         string
+	}{
+		{"MISRA C:2012", "Rule 17.7", "https://wiki.example.com/misra/17.7"},
+		// Sources match regardless of case and spacing
+		{"misra  c:2012", "Dir 4.1", "https://wiki.example.com/misra/4.1"},
+		// Placeholders are escaped as path segments
+		{"CERT C", "EXP33-C / MSC", "https://cert.example.com/CERT%20C/EXP33-C%20%2F%20MSC"},
+		// Every other source takes the "*" template
+		{"Style", "Rule 3", "file:///opt/rules/Style-3.html"},
+		{"Style", "No goto", "file:///opt/rules/Style-Nogoto.html"},
+	} {
+		if got := docs.URL(test.source, test.rule); got != test.want {
+			t.Errorf("URL(%q, %q) = %q, want %q", test.source, test.rule, got, test.want)
+		}
+	}
+
+	// Without a "*" template other sources have no documentation
+	delete(docs, "*")
+	if got := docs.URL("Style", "Rule 3"); got != "" {
+		t.Errorf("URL without fallback = %q", got)
+	}
+	if got := RuleDocs(nil).URL("MISRA C:2012", "Rule 17.7"); got != "" {
+		t.Errorf("URL without templates = %q", got)
+	}
+}
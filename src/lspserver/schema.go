@@ -0,0 +1,84 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+ * findingsSchema is the JSON schema of an analysis in structured output mode. Backends hand it
+ * to providers that constrain their output to a schema, e.g. Ollama's format and OpenAI's
+ * response_format. The findings are wrapped in an object since OpenAI requires one at the top.
+ * Strict schemas need every property listed as required, the optional ones may be null.
+ */
+var findingsSchema = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"findings": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"properties": {
+					"line_number": {"type": "integer"},
+					"end_line_number": {"type": ["integer", "null"]},
+					"column": {"type": ["integer", "null"]},
+					"snippet": {"type": ["string", "null"]},
+					"source": {"type": "string"},
+					"rule": {"type": "string"},
+					"severity": {"type": "string", "enum": ["mandatory", "required", "advisory"]},
+					"description": {"type": "string"},
+					"recommendation": {"type": "string"}
+				},
+				"required": ["line_number", "end_line_number", "column", "snippet", "source", "rule",
+					"severity", "description", "recommendation"],
+				"additionalProperties": false
+			}
+		}
+	},
+	"required": ["findings"],
+	"additionalProperties": false
+}`)
+
+// errStructuredOutputUnsupported is returned by backends whose server rejected findingsSchema,
+// the request is sent again in prompt only mode
+var errStructuredOutputUnsupported = errors.New("structured output not supported")
+
+/*
+ * schemaRejected tells whether an error response is the server refusing findingsSchema. Servers
+ * without structured output answer 400 or 422 and name the offending field.
+ */
+func schemaRejected(status int, message string) bool {
+	if status != http.StatusBadRequest && status != http.StatusUnprocessableEntity {
+		return false
+	}
+	message = strings.ToLower(message)
+	return strings.Contains(message, "format") || strings.Contains(message, "schema")
+}
+
+// structuredAnalysis is one answer in structured output mode
+type structuredAnalysis struct {
+	Findings *[]LspDiagnostic `json:"findings"`
+}
+
+/*
+ * structuredFindings decodes an analysis made of structured output answers, one per request.
+ * @param analysis The concatenated answers
+ * @return diagnostics The findings of all answers, possibly none
+ * @return ok False when any answer does not follow findingsSchema
+ */
+func structuredFindings(analysis string) ([]LspDiagnostic, bool) {
+	decoder := json.NewDecoder(strings.NewReader(analysis))
+	diagnostics := []LspDiagnostic{}
+	answers := 0
+	for decoder.More() {
+		var answer structuredAnalysis
+		if err := decoder.Decode(&answer); err != nil || answer.Findings == nil {
+			return nil, false
+		}
+		diagnostics = append(diagnostics, *answer.Findings...)
+		answers++
+	}
+	return diagnostics, answers > 0
+}
@@ -7,12 +7,20 @@ package lspserver
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
-	"os"
+	"path"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/TobiasYin/go-lsp/jsonrpc"
 	"github.com/TobiasYin/go-lsp/logs"
 	"github.com/TobiasYin/go-lsp/lsp"
 	"github.com/TobiasYin/go-lsp/lsp/defines"
@@ -21,20 +29,45 @@ import (
 // Keep the lsp protocol implementation separate from the rest of the application
 type LspServer interface {
 	Start() error
+	OnInitialize(ctx context.Context, req *defines.InitializeParams) (*defines.InitializeResult, *defines.InitializeError)
 	OnInitialized(ctx context.Context, req *defines.InitializeParams) error
+	OnShutdown(ctx context.Context, req *interface{}) error
+	OnExit(ctx context.Context, req *interface{}) error
 	OnDidOpenTextDocument(ctx context.Context, req *defines.DidOpenTextDocumentParams) error
 	OnDidChangeTextDocument(ctx context.Context, req *defines.DidChangeTextDocumentParams) error
 	OnDidSaveTextDocument(ctx context.Context, req *defines.DidSaveTextDocumentParams) error
+	OnDidChangeConfiguration(ctx context.Context, req *defines.DidChangeConfigurationParams) error
+	OnExecuteCommand(ctx context.Context, req *defines.ExecuteCommandParams) (interface{}, error)
 	OnHover(ctx context.Context, req *defines.HoverParams) (result *defines.Hover, err error)
-	OnDiagnostic(ctx context.Context, req *defines.DocumentDiagnosticParams) (*defines.FullDocumentDiagnosticReport, error)
+	OnCodeLens(ctx context.Context, req *defines.CodeLensParams) (*[]defines.CodeLens, error)
+	OnDiagnostic(ctx context.Context, req *defines.DocumentDiagnosticParams) (defines.DocumentDiagnosticReport, error)
+	OnWorkspaceDiagnostic(ctx context.Context, req *defines.WorkspaceDiagnosticParams) (*defines.WorkspaceDiagnosticReport, error)
 	OnCompletion(ctx context.Context, req *defines.CompletionParams) (result *[]defines.CompletionItem, err error)
 }
 
 type lspServer struct {
-	name      string
-	server    *lsp.Server
-	backend   LspBackend
-	documents LspDocuments
+	name     string
+	server   *lsp.Server
+	backend  LspBackend
+	settings Settings
+	catalog  RuleCatalog
+	// Backends of the routes in settings, see documentBackend
+	routes *backendPool
+	// Guards backend, settings, catalog and routes, all are replaced when a client changes its configuration
+	mutex sync.RWMutex
+	// Serialises applySettings, the new backend starts without holding mutex
+	applyMutex sync.Mutex
+	// Shared by every session, see analysisCache
+	cache *analysisCache
+	// Per client state keyed by session id, see clientSession
+	sessions      map[int]*clientSession
+	sessionsMutex sync.Mutex
+	// Serving several clients over a socket, the backend must survive their shutdown
+	shared bool
+	// Analyses in flight, the background workspace analysis waits for none to be running
+	running analysisCounter
+	// Set once the clients were told the backend is unavailable, see reportBackendError
+	backendDown int32
 }
 
 func NewLspServer(name string) LspServer {
@@ -44,20 +77,19 @@ func NewLspServer(name string) LspServer {
 }
 
 func (l *lspServer) Start() error {
+	var err error
 	logs.Printf("LspServer starting...")
 
-	switch *ParamBackend {
-	case "openai":
-		l.backend = NewOpenAiBackend()
-	case "ollama":
-		l.backend = NewOllamaBackend()
-	default:
-		logs.Printf("Invalid backend: %s", *ParamBackend)
-		os.Exit(1)
+	l.settings = DefaultSettings()
+	l.catalog = loadRuleCatalog(l.settings.RuleCatalog)
+	l.backend, err = newBackend(l.settings)
+	if err != nil {
+		return err
 	}
+	l.routes = newBackendPool()
 
-	l.documents = NewLspDocuments()
-	logs.Printf("[+] New LSP Document [ %s ] ", l.documents)
+	l.cache = newAnalysisCache()
+	l.sessions = make(map[int]*clientSession)
 	return l.backend.Start()
 }
 
@@ -71,64 +103,311 @@ func (l *lspServer) Start() error {
  * @return error Any error that occurred during the request
  */
 func (l *lspServer) OnInitialized(ctx context.Context, req *defines.InitializeParams) error {
-	logs.Printf("OnInitialized: %s", req)
+	logs.Printf("OnInitialized: %v", req)
 	l.server.OnDidOpenTextDocument(l.OnDidOpenTextDocument)
+	err := l.pullSettings(ctx)
+	l.startWorkspaceAnalysis(ctx)
+	return err
+}
+
+/*
+ * OnShutdown is called when the client wants the server to stop. Backend calls in flight are
+ * cancelled and stores that keep state outside the process are flushed. The lsp server rejects
+ * every request of this client but exit from now on. A shared server only cancels the analyses
+ * and flushes the documents of the client, the backend keeps serving the others.
+ *
+ * @param ctx The context of the request.
+ * @param req The shutdown request has no params.
+ * @return error Any error that occurred while flushing
+ */
+func (l *lspServer) OnShutdown(ctx context.Context, req *interface{}) error {
+	logs.Printf("OnShutdown")
+	session := l.session(ctx)
+	if session == nil {
+		return errSessionClosed
+	}
+	atomic.StoreInt32(&session.closed, 1)
+	session.stopAnalyses()
+
+	stores := []interface{}{session.documents}
+	if !l.shared {
+		for _, backend := range l.allBackends() {
+			backend.Cancel()
+			stores = append(stores, backend)
+		}
+	}
+
+	var err error
+	for _, store := range stores {
+		if closer, ok := store.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				logs.Printf("Error flushing %T: %v", store, closeErr)
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// OnExit is called when the client is done with the server, lsp.Server.Run returns afterwards
+// unless the server is shared, then only the connection of the client is closed.
+func (l *lspServer) OnExit(ctx context.Context, req *interface{}) error {
+	logs.Printf("OnExit")
+	return nil
+}
+
+/*
+ * reportBackendError tells every client once that the backend is unavailable, i.e. that its
+ * circuit opened. Until the backend answers again further failures are only logged.
+ *
+ * @param err The error of the backend, any other error than ErrBackendUnavailable is ignored
+ */
+func (l *lspServer) reportBackendError(err error) {
+	if !errors.Is(err, ErrBackendUnavailable) || !atomic.CompareAndSwapInt32(&l.backendDown, 0, 1) {
+		return
+	}
+	params := defines.ShowMessageParams{Type: defines.MessageTypeWarning, Message: fmt.Sprintf("%s: %v", l.name, err)}
+	for _, session := range l.allSessions() {
+		if session.rpc == nil || session.isClosed() {
+			continue
+		}
+		if err := session.rpc.Notify("window/showMessage", params); err != nil {
+			logs.Printf("window/showMessage failed: %v", err)
+		}
+	}
+}
+
+// backendAvailable marks the backend as answering, its next outage is reported again
+func (l *lspServer) backendAvailable() {
+	atomic.StoreInt32(&l.backendDown, 0)
+}
+
+func (l *lspServer) getSettings() Settings {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.settings
+}
+
+// loadRuleCatalog loads the catalog shown in hovers, hovers work without one so errors are only logged
+func loadRuleCatalog(fileName string) RuleCatalog {
+	catalog, err := LoadRuleCatalog(fileName)
+	if err != nil {
+		logs.Printf("Error loading rule catalog %s: %v", fileName, err)
+	}
+	return catalog
+}
+
+/*
+ * OnDidChangeConfiguration is called when the user changes the client settings. Clients using
+ * the pull model send no settings, in which case they are requested with workspace/configuration.
+ *
+ * @param ctx The context of the request.
+ * @param req The changed settings.
+ * @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnDidChangeConfiguration(ctx context.Context, req *defines.DidChangeConfigurationParams) error {
+	logs.Printf("OnDidChangeConfiguration: %v", req)
+
+	settings, err := SettingsUnmarshal(req.Settings)
+	if err != nil {
+		logs.Printf("Error unmarshalling settings: %v", err)
+		return err
+	}
+	if settings == nil {
+		return l.pullSettings(ctx)
+	}
+	return l.applySettings(ctx, *settings)
+}
+
+// pullSettings requests our settings section from the client, clients without support are ignored.
+func (l *lspServer) pullSettings(ctx context.Context) error {
+	session := jsonrpc.SessionFromContext(ctx)
+	if session == nil {
+		return nil
+	}
+
+	section := SettingsSection
+	params := defines.ConfigurationParams{Items: []defines.ConfigurationItem{{Section: &section}}}
+	var result []json.RawMessage
+	err := session.Call(ctx, "workspace/configuration", params, &result)
+	if err != nil {
+		logs.Printf("workspace/configuration not available: %v", err)
+		return nil
+	}
+	if len(result) == 0 || string(result[0]) == "null" {
+		return nil
+	}
+
+	var settings Settings
+	if err = json.Unmarshal(result[0], &settings); err != nil {
+		logs.Printf("Error unmarshalling settings: %v", err)
+		return err
+	}
+	return l.applySettings(ctx, settings)
+}
+
+/*
+ * applySettings switches to a new configuration. The backend is only recreated when something
+ * changed, in which case the documents of every client are analysed again and the clients are
+ * asked to pull the new diagnostics. Settings are shared by all clients of a socket mode server.
+ * The new backend is started before it replaces the current one, readers are never held up.
+ *
+ * @param ctx The context of the request.
+ * @param overrides The settings sent by the client, those in clientSettings are applied on top of
+ * the command line defaults.
+ * @return error Any error that occurred while starting the new backend
+ */
+func (l *lspServer) applySettings(ctx context.Context, overrides Settings) error {
+	overrides, err := overrides.clientOverrides()
+	if err != nil {
+		return err
+	}
+	settings := DefaultSettings().Merge(overrides)
+
+	l.applyMutex.Lock()
+	defer l.applyMutex.Unlock()
+	if settings.Equal(l.getSettings()) {
+		return nil
+	}
+
+	// Starting may reach out to the backend, the current one keeps serving meanwhile
+	backend, err := newBackend(settings)
+	if err == nil {
+		err = backend.Start()
+	}
+	if err != nil {
+		logs.Printf("Keeping previous settings, new backend failed: %v", err)
+		return err
+	}
+	catalog := loadRuleCatalog(settings.RuleCatalog)
+
+	l.mutex.Lock()
+	previous, previousRoutes := l.backend, l.routes
+	l.backend = backend
+	l.routes = newBackendPool()
+	l.settings = settings
+	l.catalog = catalog
+	l.mutex.Unlock()
+	l.backendAvailable()
+
+	// Backends with state outside the process, e.g. a recording, are done once replaced
+	if closer, ok := previous.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logs.Printf("Error closing previous backend: %v", err)
+		}
+	}
+	if err := previousRoutes.Close(); err != nil {
+		logs.Printf("Error closing previous routed backends: %v", err)
+	}
+
+	logs.Printf("[+] Settings changed, re-analysing open documents")
+	l.cache.Clear()
+	// Notifications are handled in order, the re-analysis must not hold up the next one
+	for _, session := range l.allSessions() {
+		// Files analysed in the background are analysed again only if the settings still ask for it
+		session.workspace.ClearAnalysis()
+		go func(ctx context.Context) {
+			for uri, text := range l.documents(ctx).Dump() {
+				if err := l.analyseDocument(ctx, uri, text); err != nil {
+					logs.Printf("Error re-analysing %s: %v", uri, err)
+				}
+			}
+			l.refreshDiagnostics(ctx)
+			l.startWorkspaceAnalysis(ctx)
+		}(session.context())
+	}
 	return nil
 }
 
 /*
- * updateDocumentStore is helper for updating internal state whenever the document is opened
- * or saved by the client.
+ * updateDocumentStore is helper for updating internal state whenever the document is opened,
+ * changed or saved by the client. The document is stored right away, the analysis runs in the
+ * background and the client is asked to pull the diagnostics once it is done. A change cancels
+ * the analysis of the previous version, analyses only start once typing paused for analysisDelay.
  *
  * @param ctx The context of the request.
  * @param req The open text document params.
  * @return error Any error that occurred during the request
  */
 
-func (l *lspServer) updateDocumentStore(uri string, text string) error {
-	var analysis string
-	var diagnostics []LspDiagnostic
+func (l *lspServer) updateDocumentStore(ctx context.Context, uri string, text string) error {
 	logs.Printf("=> URI: [%s] TEXT: [%s]", uri, text)
-	err := l.documents.Store(uri, text)
+	err := l.documents(ctx).Store(uri, text)
 	if err != nil {
 		// This is ok, the document may already be stored
 		return nil
 	}
 
-	const maxRetries = 5
-	instruction := ""
-
-	for attempts := 1; attempts <= maxRetries; attempts++ {
-		analysis, err = l.backend.AnalyseDocument(uri, instruction+text)
-		if err != nil {
-			return err
+	// The notification is answered before the analysis starts, its context is done by then
+	session := l.session(ctx)
+	if session == nil {
+		return errSessionClosed
+	}
+	analysisCtx, analysis := session.startAnalysis(session.context(), uri)
+	go func() {
+		defer session.endAnalysis(uri, analysis)
+		select {
+		case <-time.After(analysisDelay):
+		case <-analysisCtx.Done():
+			return
 		}
-		err = l.documents.StoreAnalysis(uri, analysis)
-		if err != nil {
-			return err
+		if session.isClosed() {
+			return
 		}
-		diagnostics, err = DiagnosticsUnmarshal(uri, analysis)
-		if err != nil {
-			if attempts < maxRetries {
-				logs.Printf("AnalyseDocument attempt %d/%d failed: %v. Retrying...", attempts, maxRetries, err)
-			} else {
-				logs.Printf("AnalyseDocument attempt %d/%d failed: %v. No more retries.", attempts, maxRetries, err)
-				return err
+		if err := l.analyseDocument(analysisCtx, uri, text); err != nil {
+			if analysisCtx.Err() == nil {
+				logs.Printf("Error analysing %s: %v", uri, err)
 			}
-			var temp []byte
-			temp, err = LoadPrompt(*ParamRetryPromptFile)
-			instruction = string(temp)
-		} else {
-			break
+			return
 		}
+		l.refreshDiagnostics(analysisCtx)
+	}()
+	return nil
+}
+
+// analysisDelay is how long a document has to stay unchanged before it is analysed
+const analysisDelay = 300 * time.Millisecond
+
+// isCurrent tells whether text is still the stored text of uri, results for older texts are dropped
+func (l *lspServer) isCurrent(ctx context.Context, uri string, text string) bool {
+	current, err := l.documentStore(ctx, uri).Load(uri)
+	return err == nil && current == text
+}
+
+// analyseDocument runs the backend over text and stores the resulting diagnostics, retrying
+// whenever the backend output cannot be parsed. Progress is reported to the client throughout.
+// Texts analysed before, by any client, are answered from the shared cache.
+func (l *lspServer) analyseDocument(ctx context.Context, uri string, text string) error {
+	documents := l.documentStore(ctx, uri)
+	cacheText := l.cacheText(ctx, uri, text)
+	if cached, ok := l.cache.Load(cacheText); ok {
+		logs.Printf("Using cached analysis for URI: %s", uri)
+		if !l.isCurrent(ctx, uri, text) {
+			return nil
+		}
+		documents.StoreAnalysis(uri, cached.analysis)
+		return documents.UpdateDiagnostics(uri, cached.diagnostics)
 	}
 
+	analysis, diagnostics, err := l.runAnalysis(ctx, uri, text, "Analysing "+path.Base(uri), l.streamFindings(ctx, uri, text))
+	if err == nil {
+		l.cache.Store(cacheText, analysis, diagnostics)
+	}
+	if !l.isCurrent(ctx, uri, text) {
+		logs.Printf("Dropping the analysis of an outdated version of %s", uri)
+		return err
+	}
+	if analysis != "" {
+		// Unparsable output is kept too, llmlint.showRawAnalysis is how it gets debugged
+		if storeErr := documents.StoreAnalysis(uri, analysis); storeErr != nil {
+			return storeErr
+		}
+	}
 	if err != nil {
-		logs.Printf("Failed to analyze document after %d attempts: %v\n", maxRetries, err)
 		return err
 	}
 
-	err = l.documents.UpdateDiagnostics(uri, diagnostics)
+	err = documents.UpdateDiagnostics(uri, diagnostics)
 	if err != nil {
 		logs.Printf("Failed to update diagnostics: %v\n", err)
 		return err
@@ -138,6 +417,110 @@ func (l *lspServer) updateDocumentStore(uri string, text string) error {
 	return nil
 }
 
+// Streamed findings ask the client to pull diagnostics at most this often
+const streamRefreshInterval = 500 * time.Millisecond
+
+/*
+ * streamFindings returns the FindingFunc showing the findings of a document while it is being
+ * analysed. Each finding is stored right away, the client is asked to pull the diagnostics at
+ * most every streamRefreshInterval. The final diagnostics replace the streamed ones. Findings
+ * are dropped once text is no longer the current text of the document.
+ */
+func (l *lspServer) streamFindings(ctx context.Context, uri string, text string) FindingFunc {
+	var streamed []LspDiagnostic
+	var lastRefresh time.Time
+	return func(finding LspDiagnostic) {
+		finding.Uri = uri
+		// Overlapping chunks report the findings near their cuts twice
+		if slices.ContainsFunc(streamed, func(d LspDiagnostic) bool { return sameFinding(d, finding) }) {
+			return
+		}
+		streamed = append(streamed, finding)
+		if !l.isCurrent(ctx, uri, text) {
+			return
+		}
+		if err := l.documentStore(ctx, uri).UpdateDiagnostics(uri, slices.Clone(streamed)); err != nil {
+			logs.Printf("Failed to store streamed finding: %v", err)
+			return
+		}
+		if time.Since(lastRefresh) >= streamRefreshInterval {
+			lastRefresh = time.Now()
+			// The client answers the refresh with a pull, the stream must not wait for it. The
+			// request that started the analysis may be answered by the time the refresh is sent.
+			go l.refreshDiagnostics(l.session(ctx).context())
+		}
+	}
+}
+
+/*
+ * runAnalysis runs the backend over text until its output can be parsed, the result is not stored.
+ *
+ * @param ctx The context of the request, used to report progress.
+ * @param uri The document URI.
+ * @param text The text to analyse, line numbers in the result are relative to it.
+ * @param title The progress title shown by the client.
+ * @param findings Receives the findings of the first attempt while they are streamed, may be nil.
+ * @return analysis The raw backend output
+ * @return diagnostics The parsed diagnostics
+ * @return error Any error that occurred during the analysis
+ */
+func (l *lspServer) runAnalysis(ctx context.Context, uri string, text string, title string, findings FindingFunc) (analysis string, diagnostics []LspDiagnostic, err error) {
+	const maxRetries = 5
+	instruction := ""
+	backend, settings, err := l.documentBackend(ctx, uri)
+	if err != nil {
+		return "", nil, err
+	}
+
+	l.running.add(1)
+	defer l.running.add(-1)
+
+	progress := l.beginProgress(ctx, nil, title)
+	defer func() {
+		if err != nil {
+			progress.End("analysis failed")
+		} else {
+			progress.End(fmt.Sprintf("%d findings", len(diagnostics)))
+		}
+	}()
+
+	for attempts := 1; attempts <= maxRetries; attempts++ {
+		var response *AnalysisResponse
+		response, err = backend.AnalyseDocument(ctx, &AnalysisRequest{
+			URI:         uri,
+			Document:    text,
+			RetryPrompt: instruction,
+			Progress:    progress.Report,
+			Findings:    findings,
+		})
+		if err != nil {
+			l.reportBackendError(err)
+			return "", nil, err
+		}
+		l.backendAvailable()
+		analysis = response.Analysis
+		diagnostics, err = DiagnosticsUnmarshal(uri, analysis)
+		if err == nil {
+			return analysis, diagnostics, nil
+		}
+		if attempts == maxRetries {
+			logs.Printf("AnalyseDocument attempt %d/%d failed: %v. No more retries.", attempts, maxRetries, err)
+			break
+		}
+		logs.Printf("AnalyseDocument attempt %d/%d failed: %v. Retrying...", attempts, maxRetries, err)
+
+		var temp []byte
+		temp, err = LoadPrompt(settings.RetryPromptFile)
+		instruction = string(temp)
+		// The findings streamed so far stay until the retry is parsed, streaming it as well
+		// would show them twice
+		findings = nil
+	}
+
+	logs.Printf("Failed to analyze document after %d attempts: %v\n", maxRetries, err)
+	return analysis, nil, err
+}
+
 /*
  * OnDidOpenTextDocument is called when a text document is opened in a client.
  *
@@ -147,9 +530,10 @@ func (l *lspServer) updateDocumentStore(uri string, text string) error {
  */
 
 func (l *lspServer) OnDidOpenTextDocument(ctx context.Context, req *defines.DidOpenTextDocumentParams) error {
-	logs.Printf("OnDidOpenTextDocument:\n%s", req)
+	logs.Printf("OnDidOpenTextDocument:\n%v", req)
 
-	return l.updateDocumentStore(string(req.TextDocument.Uri), req.TextDocument.Text)
+	l.session(ctx).setLanguage(string(req.TextDocument.Uri), req.TextDocument.LanguageId)
+	return l.updateDocumentStore(ctx, string(req.TextDocument.Uri), req.TextDocument.Text)
 }
 
 // ConvertFileURIToPath converts a file URI to a system-specific file path
@@ -178,82 +562,45 @@ func ReadFileContent(filePath string) (string, error) {
 	return string(content), nil
 }
 
+/*
+ * OnDidChangeTextDocument is called when the user edits a document. The server asks for full
+ * document sync, so the last content change holds the complete buffer.
+ *
+ * @param ctx The context of the request.
+ * @param req The change text document params from the client.
+ * @return error Any error that occurred during the request
+ */
 func (l *lspServer) OnDidChangeTextDocument(ctx context.Context, req *defines.DidChangeTextDocumentParams) error {
-	uri := req.TextDocument.TextDocumentIdentifier.Uri
-
-	logs.Printf("[+] OnDidChangeTextDocument: %s", string(uri))
+	uri := string(req.TextDocument.TextDocumentIdentifier.Uri)
 
-	filePath, err := ConvertFileURIToPath(string(uri))
-
-	if err != nil {
-		logs.Printf("Error converting URI to file path: %v\n", err)
-		return err
-	}
-	// var content string
-	// var err error
-	documentContent, err := ReadFileContent(filePath)
-	// Fetch the latest content of the document
-	// content, err := os.ReadFile(string(uri))
-	if err != nil {
-		logs.Printf("Error loading document content: %s", err)
-		return err
-	}
+	logs.Printf("[+] OnDidChangeTextDocument: %s", uri)
 
-	// Analyze the document content
-	analysis, err := l.backend.AnalyseDocument(string(uri), string(documentContent))
-	if err != nil {
-		logs.Printf("Error analyzing document: %s", err)
-		return err
-	}
-
-	// Update the analysis in the document store
-	if err = l.documents.StoreAnalysis(string(uri), analysis); err != nil {
-		logs.Printf("Error storing document analysis: %s", err)
-		return err
-	}
-
-	// Unmarshal diagnostics from the analysis
-	diagnostics, err := DiagnosticsUnmarshal(string(uri), analysis)
-	if err != nil {
-		logs.Printf("Error unmarshalling diagnostics: %s", err)
-		return err
+	if len(req.ContentChanges) == 0 {
+		return nil
 	}
-
-	err = l.documents.UpdateDiagnostics(string(uri), diagnostics)
-
-	// Update diagnostics in the document store
-	if err != nil {
-		logs.Printf("Error updating diagnostics: %s", err)
-		return err
+	text, ok := req.ContentChanges[len(req.ContentChanges)-1].Text.(string)
+	if !ok {
+		return fmt.Errorf("unexpected content change for %s", uri)
 	}
-	// l.documents.UpdateDiagnostics(uri, diagnostics)
-	// Send diagnostics to the client
-	l.updateDocumentStore(string(uri), string(documentContent))
 
-	return nil
+	return l.updateDocumentStore(ctx, uri, text)
 }
 
 func (l *lspServer) OnDidSaveTextDocument(ctx context.Context, req *defines.DidSaveTextDocumentParams) error {
 
-	logs.Printf("OnDidSaveTextDocument:\n%s", req)
-
-	logs.Printf("URI: %s | Text: %s ", string(req.TextDocument.Uri), req.Text)
-	filePath, err := ConvertFileURIToPath(string(req.TextDocument.Uri))
+	logs.Printf("OnDidSaveTextDocument:\n%v", req)
 
-	if err != nil {
-		logs.Printf("Error converting URI to file path: %v\n", err)
-		return err
-	}
+	logs.Printf("URI: %s | Text: %v ", string(req.TextDocument.Uri), req.Text)
 	// var content string
 	// var err error
-	documentContent, err := ReadFileContent(filePath)
+	documentContent, err := l.readDocument(ctx, string(req.TextDocument.Uri))
 	if err != nil {
 		logs.Printf("Error loading document content: %s", err)
 		return err
 	}
 	// TODO: Add IncludeText to server capabilities
 	if documentContent != "" {
-		return l.updateDocumentStore(string(req.TextDocument.Uri), documentContent)
+		return l.updateDocumentStore(ctx, string(req.TextDocument.Uri), documentContent)
 	}
 
 	return nil
@@ -262,117 +609,152 @@ func (l *lspServer) OnDidSaveTextDocument(ctx context.Context, req *defines.DidS
 /*
  * OnDiagnostic is called when a text document is opened in a client.
  * The client will send a notification to the server requesting diagnostics (Pull Diagnostics)
+ * When the client already has the current diagnostics, identified by previousResultId, an
+ * unchanged report is sent instead of the full one.
  *
  * @param ctx The context of the request.
  * @param req The diagnostic document param from the client.
- * @return report The full diagnostic report
+ * @return report The full or unchanged diagnostic report
  * @return error Any error that occurred during the request
  */
 
-func (l *lspServer) OnDiagnostic(ctx context.Context, req *defines.DocumentDiagnosticParams) (*defines.FullDocumentDiagnosticReport, error) {
-	logs.Printf("OnDiagnostic called for URI: %s", req.TextDocument.Uri)
+func (l *lspServer) OnDiagnostic(ctx context.Context, req *defines.DocumentDiagnosticParams) (defines.DocumentDiagnosticReport, error) {
+	uri := string(req.TextDocument.Uri)
+	logs.Printf("OnDiagnostic called for URI: %s", uri)
+
+	// Read before the items, a change in between only costs the client another full report
+	resultId := l.documentStore(ctx, uri).ResultId(uri)
+	if resultId != "" && req.PreviousResultId != nil && *req.PreviousResultId == resultId {
+		logs.Printf("Diagnostics unchanged for URI %s\n", uri)
+		return defines.UnchangedDocumentDiagnosticReport{
+			Kind:     defines.DocumentDiagnosticReportKindUnChanged,
+			ResultId: resultId,
+		}, nil
+	}
 
-	diagnostics := []defines.Diagnostic{}
-	report := defines.FullDocumentDiagnosticReport{}
+	report := defines.FullDocumentDiagnosticReport{
+		Kind:  defines.DocumentDiagnosticReportKindFull,
+		Items: []interface{}{},
+	}
+	if resultId != "" {
+		report.ResultId = &resultId
+	}
 
-	docDiagnostics, err := l.documents.GetDiagnostics(string(req.TextDocument.Uri))
+	items, err := l.diagnosticItems(ctx, uri)
 	if err != nil {
-		logs.Printf("Error getting diagnostics for URI %s: %v\n", req.TextDocument.Uri, err)
-		return &report, nil
+		logs.Printf("Error getting diagnostics for URI %s: %v\n", uri, err)
+		return report, nil
 	}
+	report.Items = items
+
+	logs.Printf("Diagnostics report created with %d items for URI %s\n", len(items), uri)
+	return report, nil
+}
+
+// diagnosticItems converts the stored diagnostics of a document into LSP diagnostics
+func (l *lspServer) diagnosticItems(ctx context.Context, uri string) ([]interface{}, error) {
+	documents := l.documentStore(ctx, uri)
+	docDiagnostics, err := documents.GetDiagnostics(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	// The text is only used to refine the ranges, a missing document still yields whole lines
+	text, _ := documents.Load(uri)
 
+	l.mutex.RLock()
+	ruleDocs, catalog := l.settings.RuleDocs, l.catalog
+	l.mutex.RUnlock()
+
+	items := []interface{}{}
 	for _, d := range docDiagnostics {
 		var diagnostic defines.Diagnostic
 		var severity defines.DiagnosticSeverity
-		message := DiagnosticToPrettyText(d)
 
 		switch d.Severity {
 		case "advisory":
 			severity = defines.DiagnosticSeverityWarning
-		case "mandatory":
+		case "mandatory", "required":
 			severity = defines.DiagnosticSeverityError
 		default:
 			severity = defines.DiagnosticSeverityHint
 		}
 
-		diagRange := defines.Range{
-			Start: defines.Position{Line: uint(d.LineNumber - 1), Character: 0},
-			End:   defines.Position{Line: uint(d.LineNumber - 1), Character: 5},
-		}
-
-		relatedInfo := []defines.DiagnosticRelatedInformation{
-			{
-				Location: defines.Location{
-					Uri:   req.TextDocument.Uri,
-					Range: diagRange,
-				},
-				Message: message,
-			},
+		message := d.Description
+		if d.Recommendation != "" {
+			message += "\nRecommendation: " + d.Recommendation
 		}
 
-		searchUrl := fmt.Sprintf("https://bing.com/search?=\"%s\"", d.Source)
 		diagnostic = defines.Diagnostic{
-			Range:              diagRange,
-			Severity:           &severity,
-			Code:               d.Source + " " + d.Rule,
-			Source:             &l.name,
-			Message:            d.Description,
-			CodeDescription:    &defines.CodeDescription{Href: defines.URI(searchUrl)},
-			RelatedInformation: &relatedInfo,
+			Range:    DiagnosticRange(d, text),
+			Severity: &severity,
+			Code:     d.Source + " " + d.Rule,
+			Source:   &l.name,
+			Message:  message,
 		}
 
-		diagnostics = append(diagnostics, diagnostic)
-	}
+		if docUrl := ruleDocs.URL(d.Source, d.Rule); docUrl != "" {
+			docMessage := d.Source + " " + d.Rule + " documentation"
+			if e, ok := catalog.Lookup(d.Source, d.Rule); ok && e.Title != "" {
+				docMessage = d.Source + " " + d.Rule + ": " + e.Title
+			}
+			diagnostic.CodeDescription = &defines.CodeDescription{Href: defines.URI(docUrl)}
+			diagnostic.RelatedInformation = &[]defines.DiagnosticRelatedInformation{
+				{
+					Location: defines.Location{Uri: defines.DocumentUri(docUrl)},
+					Message:  docMessage,
+				},
+			}
+		}
 
-	var items []interface{}
-	for _, d := range diagnostics {
-		items = append(items, d)
-	}
-	report = defines.FullDocumentDiagnosticReport{
-		Kind:  defines.DocumentDiagnosticReportKindFull,
-		Items: items,
+		items = append(items, diagnostic)
 	}
 
-	logs.Printf("Diagnostics report created with %d items for URI %s\n", len(items), req.TextDocument.Uri)
-	return &report, nil
+	return items, nil
 }
 
 /*
  * OnHover is called when a user hovers over a token in the editor. This method is then sent to the server
- * which will return a Hover object to the client.
+ * which will return a Hover object listing every finding on the hovered line.
  *
  * @param ctx The context of the request.
  * @param req The hover params from the client.
- * @return The hover object sent to the client
+ * @return The hover object sent to the client, nil when there are no findings
  * @return error Any error that occurred during the request
  */
 
 func (l *lspServer) OnHover(ctx context.Context, req *defines.HoverParams) (result *defines.Hover, err error) {
-	logs.Printf("OnHover: %s", req)
-	var value string
+	logs.Printf("OnHover: %v", req)
 
-	diagnostics, err := l.documents.GetDiagnostics(string(req.TextDocument.Uri))
+	diagnostics, err := l.documentStore(ctx, string(req.TextDocument.Uri)).GetDiagnostics(string(req.TextDocument.Uri))
 	if err != nil {
 		return nil, err
 	}
 
+	line := int(req.Position.Line) + 1
+	var findings []LspDiagnostic
 	for _, d := range diagnostics {
-		if d.LineNumber-1 != int(req.Position.Line) {
-			continue
-		}
-
-		value, err = DiagnosticToJsonMarkup(d)
-		if err != nil {
-			break
+		if line == d.LineNumber || (line > d.LineNumber && line <= d.EndLineNumber) {
+			findings = append(findings, d)
 		}
 	}
+	if len(findings) == 0 {
+		return nil, nil
+	}
 
-	return &defines.Hover{
-		Contents: defines.MarkupContent{
-			Kind:  defines.MarkupKindMarkdown,
-			Value: value,
-		},
-	}, nil
+	kind := l.session(ctx).getHoverKind()
+	l.mutex.RLock()
+	catalog := l.catalog
+	l.mutex.RUnlock()
+
+	contents := defines.MarkupContent{Kind: kind}
+	if kind == defines.MarkupKindPlainText {
+		contents.Value = DiagnosticsToPlainText(findings, catalog)
+	} else {
+		contents.Kind = defines.MarkupKindMarkdown
+		contents.Value = DiagnosticsToMarkdown(findings, catalog)
+	}
+	return &defines.Hover{Contents: contents}, nil
 }
 
 func strPtr(str string) *string {
@@ -383,75 +765,6 @@ func kindPtr(kind defines.CompletionItemKind) *defines.CompletionItemKind {
 	return &kind
 }
 
-func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionParams) (result *[]defines.CompletionItem, err error) {
-	logs.Printf("OnCompletion: %v", req)
-
-	// Define the system prompt for code completion
-	systemPrompt := "You are a coding assistant. Provide the best possible code completions based on the given context."
-
-	// Fetch the document content
-	filePath, err := ConvertFileURIToPath(string(req.TextDocument.Uri))
-	if err != nil {
-		logs.Printf("Error converting URI to file path: %v\n", err)
-		return nil, err
-	}
-
-	documentContent, err := ReadFileContent(filePath)
-	if err != nil {
-		logs.Printf("Error reading file content: %v\n", err)
-		return nil, err
-	}
-
-	if documentContent == "" {
-		return nil, fmt.Errorf("failed to retrieve document content")
-	}
-
-	// Determine the position in the document
-	line := int(req.Position.Line)
-	character := int(req.Position.Character)
-
-	// Extract the previous 3 lines as the prefix
-	startLine := line - 3
-	if startLine < 0 {
-		startLine = 0
-	}
-	lines := strings.Split(documentContent, "\n")
-
-	// Ensure the line number is within the valid range
-	if line >= len(lines) {
-		return nil, fmt.Errorf("line number out of range")
-	}
-
-	// Get the prefix lines
-	prefixLines := lines[startLine:line]
-	prefix := strings.Join(prefixLines, "\n")
-
-	// Extract the prefix up to the current character on the current line
-	if character > 0 && character <= len(lines[line]) {
-		currentLinePrefix := lines[line][:character]
-		prefix = prefix + "\n" + currentLinePrefix
-	}
-
-	// Call the backend to get completions with the custom system prompt
-	completions, err := l.backend.CompleteCode(string(req.TextDocument.Uri), prefix, systemPrompt)
-	if err != nil {
-		return nil, err
-	}
-
-	// Map completions to CompletionItems
-	var completionItems []defines.CompletionItem
-	for _, comp := range completions {
-		completionItems = append(completionItems, defines.CompletionItem{
-			Label:      comp,
-			Kind:       kindPtr(defines.CompletionItemKindText),
-			InsertText: strPtr(comp),
-		})
-	}
-
-	return &completionItems, nil
-}
-
-
 // func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionParams) (result *[]defines.CompletionItem, err error) {
 //     logs.Printf("OnCompletion: %v", req)
 
@@ -479,11 +792,44 @@ func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionPar
 //     return &completionItems, nil
 // }
 
-func Serve(name string) {
+/*
+ * Serve runs the server until the client exits.
+ *
+ * @param name The server name reported as diagnostic source.
+ * @return error Why the server could not start, or lsp.ErrNoShutdown when the client exited
+ * without a shutdown request. The process should exit with 1 whenever it is not nil.
+ */
+func Serve(name string) error {
 	lspserver := lspServer{name: name}
-	lspserver.server = lsp.NewServer(&lsp.Options{CompletionProvider: &defines.CompletionOptions{
-		TriggerCharacters: &[]string{"."},
-	}})
+
+	var network, address string
+	if ParamListen != nil && *ParamListen != "" {
+		var err error
+		network, address, err = ParseListenAddress(*ParamListen)
+		if err != nil {
+			return err
+		}
+		// Every client gets its own session, the backend outlives them all
+		lspserver.shared = true
+	}
+
+	resolveCodeLens := false
+	lspserver.server = lsp.NewServer(&lsp.Options{
+		Network: network,
+		Address: address,
+		CompletionProvider: &defines.CompletionOptions{
+			TriggerCharacters: &[]string{"."},
+		},
+		ExecuteCommandProvider: &defines.ExecuteCommandOptions{
+			Commands: Commands,
+		},
+		// Lenses are created complete, there is nothing to resolve
+		CodeLensProvider: &defines.CodeLensOptions{ResolveProvider: &resolveCodeLens},
+		DiagnosticProvider: &defines.DiagnosticOptions{
+			InterFileDependencies: false,
+			WorkspaceDiagnostics:  true,
+		},
+	})
 
 	if lspserver.server == nil {
 		panic("Error creating LspServer")
@@ -491,17 +837,23 @@ func Serve(name string) {
 
 	err := lspserver.Start()
 	if err != nil {
-		logs.Printf("start failed: %v", err)
-		os.Exit(1)
-		// TODO: handle retrying
+		return fmt.Errorf("start failed: %w", err)
 	}
 
+	lspserver.server.OnInitialize(lspserver.OnInitialize)
 	lspserver.server.OnInitialized(lspserver.OnInitialized)
 	lspserver.server.OnDidOpenTextDocument(lspserver.OnDidOpenTextDocument)
 	lspserver.server.OnDidChangeTextDocument(lspserver.OnDidChangeTextDocument)
 	lspserver.server.OnDidSaveTextDocument(lspserver.OnDidSaveTextDocument)
+	lspserver.server.OnDidChangeConfiguration(lspserver.OnDidChangeConfiguration)
+	lspserver.server.OnExecuteCommand(lspserver.OnExecuteCommand)
 	lspserver.server.OnHover(lspserver.OnHover)
+	lspserver.server.OnCodeLens(lspserver.OnCodeLens)
 	lspserver.server.OnDiagnostic(lspserver.OnDiagnostic)
+	lspserver.server.OnWorkspaceDiagnostic(lspserver.OnWorkspaceDiagnostic)
 	lspserver.server.OnCompletion(lspserver.OnCompletion)
-	lspserver.server.Run()
+	lspserver.server.OnShutdown(lspserver.OnShutdown)
+	lspserver.server.OnExit(lspserver.OnExit)
+	lspserver.server.OnSessionClosed(lspserver.closeSession)
+	return lspserver.server.Run()
 }
@@ -0,0 +1,332 @@
+package lspserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// defaultListenHost is bound when a tcp address names no host, clients are not authenticated
+const defaultListenHost = "127.0.0.1"
+
+/*
+ * ParseListenAddress splits a --listen value into the network and address passed to net.Listen.
+ * TCP addresses without a host listen on the loopback interface only.
+ *
+ * @param listen "tcp:host:port", "tcp:port", a bare port or "unix:path"
+ * @return network "tcp" or "unix"
+ * @return address The host and port or the socket path
+ * @return error Any error that occurred while parsing
+ */
+func ParseListenAddress(listen string) (string, string, error) {
+	if _, err := strconv.ParseUint(listen, 10, 16); err == nil {
+		listen = "tcp:" + listen
+	}
+	network, address, ok := strings.Cut(listen, ":")
+	if !ok || address == "" {
+		return "", "", fmt.Errorf("invalid listen address %q, expected tcp:host:port or unix:path", listen)
+	}
+	switch network {
+	case "tcp":
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			// No host at all, e.g. tcp:7998
+			host, port = "", address
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", "", fmt.Errorf("invalid port in listen address %q", listen)
+		}
+		if host == "" {
+			host = defaultListenHost
+		}
+		return network, net.JoinHostPort(host, port), nil
+	case "unix":
+		return network, address, nil
+	default:
+		return "", "", fmt.Errorf("unsupported listen network %q, expected tcp or unix", network)
+	}
+}
+
+// noSessionId keys the state used by contexts that do not come from a client connection
+const noSessionId = -1
+
+/*
+ * clientSession holds the state of one client connection. In socket mode several clients share
+ * the server, each gets its own documents while the backend and the analysis cache are shared.
+ */
+type clientSession struct {
+	rpc       *jsonrpc.Session
+	documents LspDocuments
+	// Files the client did not open, analysed in the background or by llmlint.analyzeWorkspace
+	workspace LspDocuments
+	// Guards workspaceFolders, hoverKind, capabilities, languages, analyses and stopWorkspace
+	mutex            sync.RWMutex
+	workspaceFolders []string
+	// Preferred hover format of the client
+	hoverKind defines.MarkupKind
+	// Server initiated requests the client supports
+	capabilities clientCapabilities
+	// languageId of the opened documents keyed by URI, see Route
+	languages map[string]string
+	// Analysis running for each open document keyed by URI, see startAnalysis
+	analyses map[string]*documentAnalysis
+	// Cancels the background workspace analysis, nil when none is running
+	stopWorkspace context.CancelFunc
+	// Set by the shutdown request
+	closed int32
+}
+
+// clientCapabilities are the server initiated requests a client announced support for in initialize
+type clientCapabilities struct {
+	// window/workDoneProgress/create
+	workDoneProgress bool
+	// workspace/diagnostic/refresh
+	diagnosticRefresh bool
+	// workspace/codeLens/refresh
+	codeLensRefresh bool
+}
+
+// documentAnalysis is the analysis of one version of an open document
+type documentAnalysis struct {
+	cancel context.CancelFunc
+}
+
+// errSessionClosed is returned for work of a client whose connection closed
+var errSessionClosed = errors.New("the client disconnected")
+
+// session returns the state of the client behind ctx, creating it on first use. It is nil once
+// the connection of the client closed, the state is freed by closeSession and background work
+// still holding a context of the client must not bring it back.
+func (l *lspServer) session(ctx context.Context) *clientSession {
+	rpc := jsonrpc.SessionFromContext(ctx)
+	id := noSessionId
+	if rpc != nil {
+		if rpc.Context().Err() != nil {
+			return nil
+		}
+		id = rpc.ID()
+	}
+
+	l.sessionsMutex.Lock()
+	defer l.sessionsMutex.Unlock()
+	s, ok := l.sessions[id]
+	if !ok {
+		s = &clientSession{rpc: rpc, documents: NewLspDocuments(), workspace: NewLspDocuments()}
+		l.sessions[id] = s
+	}
+	return s
+}
+
+// allSessions returns the state of every connected client
+func (l *lspServer) allSessions() []*clientSession {
+	l.sessionsMutex.Lock()
+	defer l.sessionsMutex.Unlock()
+	sessions := make([]*clientSession, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// closeSession frees the state of a client once its connection ended
+func (l *lspServer) closeSession(id int) {
+	l.sessionsMutex.Lock()
+	s, ok := l.sessions[id]
+	delete(l.sessions, id)
+	l.sessionsMutex.Unlock()
+
+	if !ok {
+		return
+	}
+	logs.Printf("[+] Session %d closed", id)
+	s.mutex.Lock()
+	if s.stopWorkspace != nil {
+		s.stopWorkspace()
+	}
+	s.mutex.Unlock()
+	if closer, ok := s.documents.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logs.Printf("Error flushing documents of session %d: %v", id, err)
+		}
+	}
+}
+
+// documents returns the document store of the client behind ctx, an empty one once the client
+// disconnected so the results of its last analyses are dropped
+func (l *lspServer) documents(ctx context.Context) LspDocuments {
+	session := l.session(ctx)
+	if session == nil {
+		return NewLspDocuments()
+	}
+	return session.documents
+}
+
+// documentStore returns the store holding a document, the open documents of the client or the
+// workspace store for files it did not open
+func (l *lspServer) documentStore(ctx context.Context, uri string) LspDocuments {
+	session := l.session(ctx)
+	if session == nil {
+		return NewLspDocuments()
+	}
+	if _, err := session.documents.Load(uri); err == nil {
+		return session.documents
+	}
+	return session.workspace
+}
+
+// context returns a context for background work that still talks to the client, it is cancelled
+// once the connection of the client closes
+func (s *clientSession) context() context.Context {
+	if s == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	if s.rpc == nil {
+		return context.Background()
+	}
+	return s.rpc.Context()
+}
+
+func (s *clientSession) getWorkspaceFolders() []string {
+	if s == nil {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.workspaceFolders
+}
+
+/*
+ * inWorkspace tells whether a file lies below one of the workspace folders of the client.
+ * Symbolic links are resolved first, so they cannot lead outside the folders.
+ *
+ * @param p The file path.
+ * @return ok Whether the server may read the file
+ */
+func (s *clientSession) inWorkspace(p string) bool {
+	if s == nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+	for _, folder := range s.getWorkspaceFolders() {
+		root, err := filepath.EvalSymlinks(folder)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *clientSession) getHoverKind() defines.MarkupKind {
+	if s == nil {
+		return defines.MarkupKindMarkdown
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.hoverKind
+}
+
+func (s *clientSession) getCapabilities() clientCapabilities {
+	if s == nil {
+		return clientCapabilities{}
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.capabilities
+}
+
+/*
+ * startAnalysis registers a new analysis of uri, cancelling the one of the previous version. Only
+ * one analysis per document runs at a time, every keystroke would otherwise start another.
+ *
+ * @param ctx The context of the session, the analysis outlives the notification that changed the
+ * document.
+ * @param uri The document URI.
+ * @return ctx The context of the analysis, cancelled once the document changes again
+ * @return analysis The analysis to hand to endAnalysis
+ */
+func (s *clientSession) startAnalysis(ctx context.Context, uri string) (context.Context, *documentAnalysis) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if previous, ok := s.analyses[uri]; ok {
+		previous.cancel()
+	}
+	if s.analyses == nil {
+		s.analyses = make(map[string]*documentAnalysis)
+	}
+	analysis := &documentAnalysis{}
+	ctx, analysis.cancel = context.WithCancel(ctx)
+	s.analyses[uri] = analysis
+	return ctx, analysis
+}
+
+// endAnalysis releases an analysis started by startAnalysis, a newer one of uri stays registered
+func (s *clientSession) endAnalysis(uri string, analysis *documentAnalysis) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	analysis.cancel()
+	if s.analyses[uri] == analysis {
+		delete(s.analyses, uri)
+	}
+}
+
+// stopAnalyses cancels the running and pending analyses of the client, the background workspace
+// analysis included
+func (s *clientSession) stopAnalyses() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, analysis := range s.analyses {
+		analysis.cancel()
+	}
+	if s.stopWorkspace != nil {
+		s.stopWorkspace()
+		s.stopWorkspace = nil
+	}
+}
+
+// setLanguage records the languageId the client opened a document with
+func (s *clientSession) setLanguage(uri string, languageId string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.languages == nil {
+		s.languages = make(map[string]string)
+	}
+	s.languages[uri] = languageId
+}
+
+// getLanguage returns the languageId of a document, empty for documents the client did not open
+func (s *clientSession) getLanguage(uri string) string {
+	if s == nil {
+		return ""
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.languages[uri]
+}
+
+// isClosed reports whether the client asked the server to shut down or disconnected
+func (s *clientSession) isClosed() bool {
+	return s == nil || atomic.LoadInt32(&s.closed) != 0
+}
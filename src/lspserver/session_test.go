@@ -0,0 +1,218 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+)
+
+func TestStartAnalysis(t *testing.T) {
+	session := &clientSession{}
+	uri := "file:///work/main.c"
+
+	first, firstAnalysis := session.startAnalysis(context.Background(), uri)
+	second, secondAnalysis := session.startAnalysis(context.Background(), uri)
+	if first.Err() == nil {
+		t.Errorf("the analysis of the previous version is still running")
+	}
+	if second.Err() != nil {
+		t.Errorf("the analysis of the current version was cancelled")
+	}
+
+	// The outdated analysis finishing leaves the current one registered
+	session.endAnalysis(uri, firstAnalysis)
+	if session.analyses[uri] != secondAnalysis || second.Err() != nil {
+		t.Errorf("ending the outdated analysis affected the current one")
+	}
+	session.endAnalysis(uri, secondAnalysis)
+	if len(session.analyses) != 0 || second.Err() == nil {
+		t.Errorf("analysis still registered after its end")
+	}
+}
+
+func TestAnalyseDocumentDropsOutdatedResults(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession), cache: newAnalysisCache()}
+	ctx := context.Background()
+	uri := "file:///work/main.c"
+	outdated, current := "int x;\n", "int x = 1;\n"
+	l.cache.Store(outdated, "[]", []LspDiagnostic{{LineNumber: 1, Rule: "Rule 8.4"}})
+	l.cache.Store(current, "[]", []LspDiagnostic{{LineNumber: 1, Rule: "Rule 8.7"}})
+
+	documents := l.documents(ctx)
+	documents.Store(uri, current)
+	if err := l.analyseDocument(ctx, uri, outdated); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics, err := documents.GetDiagnostics(uri); err == nil {
+		t.Fatalf("outdated analysis stored %+v", diagnostics)
+	}
+
+	if err := l.analyseDocument(ctx, uri, current); err != nil {
+		t.Fatal(err)
+	}
+	if diagnostics, _ := documents.GetDiagnostics(uri); len(diagnostics) != 1 || diagnostics[0].Rule != "Rule 8.7" {
+		t.Errorf("diagnostics %+v", diagnostics)
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	for _, test := range []struct {
+		listen           string
+		network, address string
+	}{
+		{"tcp:0.0.0.0:7998", "tcp", "0.0.0.0:7998"},
+		{"tcp:[::1]:7998", "tcp", "[::1]:7998"},
+		// No host means loopback, clients are not authenticated
+		{"tcp::7998", "tcp", "127.0.0.1:7998"},
+		{"tcp:7998", "tcp", "127.0.0.1:7998"},
+		{"7998", "tcp", "127.0.0.1:7998"},
+		{"unix:/run/lsp.sock", "unix", "/run/lsp.sock"},
+		{"", "", ""},
+		{"tcp:", "", ""},
+		{"tcp:host:port", "", ""},
+		{"tcp:70000", "", ""},
+		{"udp:127.0.0.1:7998", "", ""},
+		{"unix:", "", ""},
+	} {
+		network, address, err := ParseListenAddress(test.listen)
+		if network != test.network || address != test.address || (err == nil) != (test.network != "") {
+			t.Errorf("%q: %q %q %v, want %q %q", test.listen, network, address, err, test.network, test.address)
+		}
+	}
+}
+
+/*
+ * connectSession connects a client to server and returns the context of a handler of the new
+ * session. Closing the returned connection ends the session.
+ */
+func connectSession(t *testing.T, server *jsonrpc.Server, contexts chan context.Context) (context.Context, net.Conn) {
+	client, conn := net.Pipe()
+	go server.ConnComeIn(conn)
+	message := `{"jsonrpc": "2.0", "method": "ctx"}`
+	go fmt.Fprintf(client, "Content-Length: %d\r\n\r\n%s", len(message), message)
+	select {
+	case ctx := <-contexts:
+		return ctx, client
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+		return nil, nil
+	}
+}
+
+// newSessionServer returns a jsonrpc server whose ctx notification hands out its handler context
+func newSessionServer(l *lspServer) (*jsonrpc.Server, chan context.Context) {
+	contexts := make(chan context.Context, 1)
+	server := jsonrpc.NewServer()
+	server.RegisterMethod(jsonrpc.MethodInfo{
+		Name:       "ctx",
+		NewRequest: func() interface{} { return &struct{}{} },
+		Handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+			// Background work keeps the session context, the handler context ends with the handler
+			contexts <- l.session(ctx).context()
+			return nil, nil
+		},
+	})
+	server.OnSessionClosed(l.closeSession)
+	return server, contexts
+}
+
+func TestClosedSessionIsNotRecreated(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession)}
+	server, contexts := newSessionServer(l)
+	ctx, conn := connectSession(t, server, contexts)
+
+	conn.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session context not cancelled")
+	}
+	for i := 0; i < 100 && len(l.allSessions()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Background work of the client must neither fail nor bring its state back
+	if l.session(ctx) != nil {
+		t.Error("state of the closed session")
+	}
+	l.documents(ctx).Store("file:///work/main.c", "int x;\n")
+	if l.updateDocumentStore(ctx, "file:///work/main.c", "int x;\n") == nil {
+		t.Error("document of a closed session stored")
+	}
+	if sessions := l.allSessions(); len(sessions) != 0 {
+		t.Errorf("%d sessions after close", len(sessions))
+	}
+}
+
+func TestSessionsAreIsolated(t *testing.T) {
+	l := &lspServer{sessions: make(map[int]*clientSession), cache: newAnalysisCache()}
+	server, contexts := newSessionServer(l)
+	first, firstConn := connectSession(t, server, contexts)
+	defer firstConn.Close()
+	second, secondConn := connectSession(t, server, contexts)
+	defer secondConn.Close()
+	if l.session(first) == l.session(second) {
+		t.Fatal("both clients share a session")
+	}
+
+	// Both clients open the same file with different contents
+	uri, background := "file:///work/main.c", "file:///work/util.c"
+	l.documents(first).Store(uri, "int x;\n")
+	l.documents(first).UpdateDiagnostics(uri, []LspDiagnostic{{LineNumber: 1, Rule: "Rule 8.4"}})
+	l.documents(second).Store(uri, "int y;\n")
+	l.session(first).workspace.Store(background, "int z;\n")
+
+	if text, _ := l.documents(first).Load(uri); text != "int x;\n" {
+		t.Errorf("first client sees %q", text)
+	}
+	if text, _ := l.documents(second).Load(uri); text != "int y;\n" {
+		t.Errorf("second client sees %q", text)
+	}
+	if diagnostics, err := l.documents(second).GetDiagnostics(uri); err == nil {
+		t.Errorf("second client sees the diagnostics %+v of the first", diagnostics)
+	}
+	if text, err := l.documentStore(second, background).Load(background); err == nil {
+		t.Errorf("second client sees the workspace file %q of the first", text)
+	}
+
+	// The first client leaving takes none of the documents of the second along
+	firstConn.Close()
+	for i := 0; i < 100 && len(l.allSessions()) > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if text, _ := l.documents(second).Load(uri); text != "int y;\n" {
+		t.Errorf("second client sees %q after the first left", text)
+	}
+}
+
+func TestShutdownStopsPendingAnalyses(t *testing.T) {
+	backend := "test-stub"
+	ParamBackend = &backend
+	ParamBackends = map[string]json.RawMessage{"test-stub": json.RawMessage(`{"analysis": "[]"}`)}
+	defer func() { ParamBackend, ParamBackends = nil, nil }()
+
+	l := NewLspServer("lsp-test").(*lspServer)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The backend of a shared server keeps running, only the analyses of the client stop
+	l.shared = true
+	ctx := context.Background()
+	calls := stub.calls
+	if err := l.updateDocumentStore(ctx, "file:///work/main.c", "int x;\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.OnShutdown(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * analysisDelay)
+	if stub.calls != calls {
+		t.Errorf("%d backend calls after shutdown", stub.calls-calls)
+	}
+}
@@ -0,0 +1,238 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// SettingsSection is the section clients use for our settings, both in
+// workspace/didChangeConfiguration and workspace/configuration.
+const SettingsSection = "llmlint"
+
+/*
+ * Settings holds everything that can be changed while the server is running.
+ * The command line flags only provide the defaults, clients may override the
+ * fields in clientSettings at runtime. Zero values mean "use the default".
+ */
+type Settings struct {
+	Backend         string   `json:"backend,omitempty"`
+	Model           string   `json:"model,omitempty"`
+	Temperature     *float64 `json:"temperature,omitempty"`
+	PromptFile      string   `json:"prompt_file,omitempty"`
+	RetryPromptFile string   `json:"retry_prompt,omitempty"`
+	Rules           []string `json:"rules,omitempty"`
+	Include         []string `json:"include,omitempty"`
+	// Analyse the workspace files matching Include in the background, off when unset
+	WorkspaceAnalysis *bool `json:"workspace_analysis,omitempty"`
+	// Cap on the files analysed in the background, defaultWorkspaceMaxFiles when unset
+	WorkspaceMaxFiles int      `json:"workspace_max_files,omitempty"`
+	RuleCatalog       string   `json:"rule_catalog,omitempty"`
+	RuleDocs          RuleDocs `json:"rule_docs,omitempty"`
+	// Constrain the backend output to findingsSchema where the backend supports it, on when unset
+	StructuredOutput *bool `json:"structured_output,omitempty"`
+	// Context window in tokens keyed by model name prefix, see contextWindow
+	ContextWindows map[string]int `json:"context_windows,omitempty"`
+	// Documents taking another backend, model, prompt or rule set, the first match wins
+	Routes []Route `json:"routes,omitempty"`
+	// Config section of each backend keyed by backend name, see RegisterBackend. Only read from
+	// the config file, the sections hold base URLs, headers and API key sources.
+	Backends map[string]json.RawMessage `json:"backends,omitempty"`
+}
+
+/*
+ * clientSettings are the settings clients may override, by their JSON name. Anything naming a
+ * file, a host or a credential is left to the command line and config file: settings come from
+ * the workspace, and a checked-in workspace configuration must neither make the server read
+ * arbitrary files and send them to the backend nor send the API key to another host. The rule
+ * documentation links are left out too, they would point the users of the workspace anywhere.
+ */
+var clientSettings = map[string]bool{
+	"backend":             true,
+	"model":               true,
+	"temperature":         true,
+	"rules":               true,
+	"include":             true,
+	"workspace_analysis":  true,
+	"workspace_max_files": true,
+	"structured_output":   true,
+	"context_windows":     true,
+}
+
+/*
+ * clientOverrides returns the part of the settings sent by a client that clients may override,
+ * see clientSettings. The other fields are dropped and logged.
+ *
+ * @return settings The settings without the fields clients may not set
+ * @return error Any error that occurred while filtering
+ */
+func (s Settings) clientOverrides() (Settings, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return Settings{}, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return Settings{}, err
+	}
+
+	var ignored []string
+	for name := range fields {
+		if !clientSettings[name] {
+			ignored = append(ignored, name)
+			delete(fields, name)
+		}
+	}
+	if len(ignored) == 0 {
+		return s, nil
+	}
+	sort.Strings(ignored)
+	logs.Printf("Ignoring client settings %s, only the server configuration may set them", strings.Join(ignored, ", "))
+
+	var allowed Settings
+	if data, err = json.Marshal(fields); err == nil {
+		err = json.Unmarshal(data, &allowed)
+	}
+	return allowed, err
+}
+
+// DefaultSettings returns the settings given on the command line.
+func DefaultSettings() Settings {
+	s := Settings{Include: defaultInclude}
+	if ParamBackend != nil {
+		s.Backend = *ParamBackend
+	}
+	if ParamPromptFile != nil {
+		s.PromptFile = *ParamPromptFile
+	}
+	if ParamRetryPromptFile != nil {
+		s.RetryPromptFile = *ParamRetryPromptFile
+	}
+	if ParamRuleCatalog != nil {
+		s.RuleCatalog = *ParamRuleCatalog
+	}
+	s.RuleDocs = ParamRuleDocs
+	s.Backends = ParamBackends
+	s.StructuredOutput = ParamStructuredOutput
+	s.WorkspaceAnalysis = ParamWorkspaceAnalysis
+	if ParamWorkspaceMaxFiles != nil {
+		s.WorkspaceMaxFiles = *ParamWorkspaceMaxFiles
+	}
+	s.ContextWindows = ParamContextWindows
+	s.Routes = ParamRoutes
+	return s
+}
+
+// Merge returns a copy of s where every field set in overrides replaces the current value. The
+// backend sections are never replaced, see Settings.Backends.
+func (s Settings) Merge(overrides Settings) Settings {
+	if overrides.Backend != "" {
+		s.Backend = overrides.Backend
+	}
+	if overrides.Model != "" {
+		s.Model = overrides.Model
+	}
+	if overrides.Temperature != nil {
+		s.Temperature = overrides.Temperature
+	}
+	if overrides.PromptFile != "" {
+		s.PromptFile = overrides.PromptFile
+	}
+	if overrides.RetryPromptFile != "" {
+		s.RetryPromptFile = overrides.RetryPromptFile
+	}
+	if len(overrides.Rules) != 0 {
+		s.Rules = overrides.Rules
+	}
+	if len(overrides.Include) != 0 {
+		s.Include = overrides.Include
+	}
+	if overrides.WorkspaceAnalysis != nil {
+		s.WorkspaceAnalysis = overrides.WorkspaceAnalysis
+	}
+	if overrides.WorkspaceMaxFiles > 0 {
+		s.WorkspaceMaxFiles = overrides.WorkspaceMaxFiles
+	}
+	if overrides.RuleCatalog != "" {
+		s.RuleCatalog = overrides.RuleCatalog
+	}
+	if len(overrides.RuleDocs) != 0 {
+		s.RuleDocs = overrides.RuleDocs
+	}
+	if overrides.StructuredOutput != nil {
+		s.StructuredOutput = overrides.StructuredOutput
+	}
+	if len(overrides.ContextWindows) != 0 {
+		// Models keep their configured window unless overridden
+		windows := make(map[string]int, len(s.ContextWindows)+len(overrides.ContextWindows))
+		for model, tokens := range s.ContextWindows {
+			windows[model] = tokens
+		}
+		for model, tokens := range overrides.ContextWindows {
+			windows[model] = tokens
+		}
+		s.ContextWindows = windows
+	}
+	if len(overrides.Routes) != 0 {
+		s.Routes = overrides.Routes
+	}
+	return s
+}
+
+// structuredOutput tells whether backends should ask for output following findingsSchema
+func (s Settings) structuredOutput() bool {
+	return s.StructuredOutput == nil || *s.StructuredOutput
+}
+
+// workspaceAnalysis tells whether the workspace files are analysed in the background
+func (s Settings) workspaceAnalysis() bool {
+	return s.WorkspaceAnalysis != nil && *s.WorkspaceAnalysis
+}
+
+// workspaceMaxFiles returns how many workspace files are analysed in the background at most
+func (s Settings) workspaceMaxFiles() int {
+	if s.WorkspaceMaxFiles > 0 {
+		return s.WorkspaceMaxFiles
+	}
+	return defaultWorkspaceMaxFiles
+}
+
+func (s Settings) Equal(other Settings) bool {
+	return reflect.DeepEqual(s, other)
+}
+
+/*
+ * SettingsUnmarshal decodes the settings sent with workspace/didChangeConfiguration. Clients
+ * wrap each section in an object keyed by the section name, so only SettingsSection is read.
+ * @param raw The settings object sent by the client
+ * @return settings The decoded settings, nil when the client sent nothing for us
+ * @return error Any error that occurred during unmarshalling
+ */
+func SettingsUnmarshal(raw interface{}) (*Settings, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections map[string]json.RawMessage
+	if err = json.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+	section, ok := sections[SettingsSection]
+	if !ok || string(section) == "null" {
+		return nil, nil
+	}
+
+	var settings Settings
+	if err = json.Unmarshal(section, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
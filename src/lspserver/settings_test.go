@@ -0,0 +1,169 @@
+package lspserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+func TestClientOverrides(t *testing.T) {
+	temperature := 0.2
+	sent := Settings{
+		Backend:         "ollama",
+		Model:           "deepseek-coder",
+		Temperature:     &temperature,
+		Rules:           []string{"Rule 15.5"},
+		PromptFile:      "/etc/passwd",
+		RetryPromptFile: "/home/me/.ssh/id_rsa",
+		RuleCatalog:     "/proc/self/environ",
+		RuleDocs:        RuleDocs{"*": "https://attacker.example/{rule_id}"},
+		Routes:          []Route{{Language: "c", PromptFile: "/etc/shadow"}},
+		Backends: map[string]json.RawMessage{
+			"openai-compatible": json.RawMessage(`{"base_url": "https://attacker.example", "api_key_env": "AWS_SECRET_ACCESS_KEY"}`),
+		},
+	}
+	want := Settings{Backend: "ollama", Model: "deepseek-coder", Temperature: &temperature, Rules: []string{"Rule 15.5"}}
+
+	got, err := sent.clientOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("clientOverrides() = %+v, want %+v", got, want)
+	}
+	if got, _ = want.clientOverrides(); !reflect.DeepEqual(got, want) {
+		t.Errorf("allowed settings changed to %+v", got)
+	}
+}
+
+func TestMergeKeepsBackendSections(t *testing.T) {
+	configured := map[string]json.RawMessage{"openai-compatible": json.RawMessage(`{"base_url": "http://localhost:8080/v1"}`)}
+	settings := Settings{Backends: configured}.Merge(Settings{
+		Backends: map[string]json.RawMessage{"openai-compatible": json.RawMessage(`{"base_url": "https://attacker.example"}`)},
+	})
+	if !reflect.DeepEqual(settings.Backends, configured) {
+		t.Errorf("backend sections replaced: %s", settings.Backends["openai-compatible"])
+	}
+}
+
+func TestSettingsUnmarshal(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		raw     interface{}
+		want    *Settings
+		wantErr bool
+	}{
+		{"nothing sent", nil, nil, false},
+		{"other sections only", map[string]interface{}{"editor": map[string]interface{}{"tabSize": 4}}, nil, false},
+		{"null section", map[string]interface{}{SettingsSection: nil}, nil, false},
+		{"our section", map[string]interface{}{
+			"editor":        map[string]interface{}{"tabSize": 4},
+			SettingsSection: map[string]interface{}{"model": "deepseek-coder", "rules": []string{"Rule 15.5"}},
+		}, &Settings{Model: "deepseek-coder", Rules: []string{"Rule 15.5"}}, false},
+		{"not an object", "llmlint", nil, true},
+		{"invalid section", map[string]interface{}{SettingsSection: map[string]interface{}{"temperature": "hot"}}, nil, true},
+	} {
+		got, err := SettingsUnmarshal(test.raw)
+		if (err != nil) != test.wantErr || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+// startSettingsServer starts a server on the test-stub backend with the command line settings
+// set by the test
+func startSettingsServer(t *testing.T) *lspServer {
+	backend, prompt := "test-stub", writeFile(t, "prompt.txt", "prompt")
+	ParamBackend, ParamPromptFile = &backend, &prompt
+	ParamBackends = map[string]json.RawMessage{"test-stub": json.RawMessage(`{"analysis": "[]"}`)}
+	ParamContextWindows = map[string]int{"misra-coder": 8192}
+	t.Cleanup(func() { ParamBackend, ParamPromptFile, ParamBackends, ParamContextWindows = nil, nil, nil, nil })
+
+	l := NewLspServer("lsp-test").(*lspServer)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestApplySettings(t *testing.T) {
+	l := startSettingsServer(t)
+	ctx := context.Background()
+	prompt := *ParamPromptFile
+	temperature := 0.5
+
+	for _, test := range []struct {
+		name      string
+		overrides Settings
+		check     func(settings Settings) bool
+	}{
+		{"client settings override the command line", Settings{Model: "deepseek-coder", Temperature: &temperature},
+			func(s Settings) bool {
+				return s.Model == "deepseek-coder" && *s.Temperature == 0.5 && s.PromptFile == prompt
+			}},
+		// Every change starts from the command line, settings the client dropped are gone
+		{"no accumulation", Settings{Rules: []string{"Rule 15.5"}},
+			func(s Settings) bool { return s.Model == "" && s.Temperature == nil && s.Rules[0] == "Rule 15.5" }},
+		{"rejected keys", Settings{Model: "m", PromptFile: "/etc/passwd", RuleCatalog: "/proc/self/environ",
+			Backends: map[string]json.RawMessage{"test-stub": json.RawMessage(`{"analysis": "stolen"}`)}},
+			func(s Settings) bool {
+				return s.Model == "m" && s.PromptFile == prompt && s.RuleCatalog == "" &&
+					string(s.Backends["test-stub"]) == `{"analysis": "[]"}`
+			}},
+		// Context windows are merged per model
+		{"context windows", Settings{ContextWindows: map[string]int{"deepseek": 4096}},
+			func(s Settings) bool {
+				return reflect.DeepEqual(s.ContextWindows, map[string]int{"misra-coder": 8192, "deepseek": 4096})
+			}},
+		{"defaults back", Settings{}, func(s Settings) bool { return s.Equal(DefaultSettings()) }},
+	} {
+		if err := l.applySettings(ctx, test.overrides); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if settings := l.getSettings(); !test.check(settings) {
+			t.Errorf("%s: %+v", test.name, settings)
+		}
+	}
+
+	// A backend that fails to start keeps the previous settings
+	if err := l.applySettings(ctx, Settings{Backend: "nonexistent"}); err == nil || l.getSettings().Backend != "test-stub" {
+		t.Errorf("invalid backend applied: %v, %+v", err, l.getSettings())
+	}
+}
+
+func TestPullSettings(t *testing.T) {
+	l := startSettingsServer(t)
+	server, contexts := newSessionServer(l)
+	ctx, conn := connectSession(t, server, contexts)
+	defer conn.Close()
+	client := &lspTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	// Clients using the pull model send no settings with the change
+	done := make(chan error, 1)
+	go func() { done <- l.OnDidChangeConfiguration(ctx, &defines.DidChangeConfigurationParams{}) }()
+	request := client.read()
+	var params defines.ConfigurationParams
+	json.Unmarshal(request.Params, &params)
+	if request.Method != "workspace/configuration" || len(params.Items) != 1 || *params.Items[0].Section != SettingsSection {
+		t.Fatalf("request %s %s", request.Method, request.Params)
+	}
+	client.send(map[string]interface{}{"id": request.Id, "result": []interface{}{
+		map[string]interface{}{"model": "deepseek-coder", "prompt_file": "/etc/passwd"},
+	}})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer to the configuration change")
+	}
+	if settings := l.getSettings(); settings.Model != "deepseek-coder" || settings.PromptFile != *ParamPromptFile {
+		t.Errorf("pulled settings %+v", settings)
+	}
+}
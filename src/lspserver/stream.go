@@ -0,0 +1,115 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+/*
+ * FindingFunc is handed to the backends so findings show up while the model is still answering.
+ * Backends call it once per finding, never concurrently. A nil FindingFunc is valid and discards
+ * all findings, the complete analysis is returned as before either way.
+ */
+type FindingFunc func(finding LspDiagnostic)
+
+func (f FindingFunc) Report(finding LspDiagnostic) {
+	if f != nil {
+		f(finding)
+	}
+}
+
+/*
+ * findingScanner picks the findings out of streamed model output. Every JSON object without
+ * nested objects is decoded as soon as its closing brace arrives, whatever surrounds it: array
+ * brackets, the wrapper object of structured output, Markdown fences and prose are skipped.
+ * Objects that are no finding are dropped. Outside objects only braces inside an array or at the
+ * start of a line open one, the quotes of prose like `Sure "{"` say nothing about JSON strings.
+ */
+type findingScanner struct {
+	findings FindingFunc
+	// The output since the outermost open object started
+	text strings.Builder
+	// Offsets of the open objects in text, innermost last
+	starts []int
+	// Whether the innermost open object contains no object so far
+	leaf     bool
+	inString bool
+	escaped  bool
+	// Arrays open outside objects
+	arrays int
+	// Whether only blanks follow the last newline outside objects
+	lineStart bool
+}
+
+func newFindingScanner(findings FindingFunc) *findingScanner {
+	return &findingScanner{findings: findings, lineStart: true}
+}
+
+// Write feeds the next piece of model output to the scanner
+func (s *findingScanner) Write(text string) {
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if len(s.starts) == 0 {
+			switch {
+			case c == '{' && (s.arrays > 0 || s.lineStart):
+				s.text.Reset()
+			case c == '[':
+				s.arrays++
+				s.lineStart = false
+				continue
+			case c == ']' && s.arrays > 0:
+				s.arrays--
+				continue
+			case c == '\n':
+				s.lineStart = true
+				continue
+			default:
+				if c != ' ' && c != '\t' && c != '\r' {
+					s.lineStart = false
+				}
+				continue
+			}
+		}
+
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case s.inString:
+			if c == '\\' {
+				s.escaped = true
+			} else if c == '"' {
+				s.inString = false
+			}
+		case c == '"':
+			s.inString = true
+		case c == '{':
+			s.starts = append(s.starts, s.text.Len())
+			s.leaf = true
+		case c == '}':
+			s.text.WriteByte(c)
+			start := s.starts[len(s.starts)-1]
+			s.starts = s.starts[:len(s.starts)-1]
+			if s.leaf {
+				s.emit(s.text.String()[start:])
+			}
+			// The enclosing object contains this one
+			s.leaf = false
+			continue
+		}
+		s.text.WriteByte(c)
+	}
+}
+
+func (s *findingScanner) emit(object string) {
+	var finding LspDiagnostic
+	if err := json.Unmarshal([]byte(object), &finding); err != nil {
+		logs.Printf("Skipping streamed object: %v", err)
+		return
+	}
+	if finding.Rule == "" && finding.Description == "" {
+		return
+	}
+	s.findings.Report(finding)
+}
@@ -0,0 +1,42 @@
+package lspserver
+
+import (
+	"testing"
+)
+
+func TestFindingScanner(t *testing.T) {
+	finding := `{"line_number": 3, "rule": "Rule 15.1", "description": "use {x} \" ok"}`
+	for _, test := range []struct {
+		name   string
+		output string
+		want   int
+	}{
+		{"array", "[" + finding + "," + finding + "]", 2},
+		{"fenced", "Here you go:\n```json\n[\n  " + finding + "\n]\n```", 1},
+		{"structured output", `{"findings": [` + finding + `]}`, 1},
+		// The quote of the prose would swallow the array as a string
+		{"brace in quoted prose", `Sure "{"` + "\n[" + finding + "]", 1},
+		{"brace in prose", "Checked f() { ... } and g().\n[" + finding + "]", 1},
+		{"prose after the array", "[" + finding + "]\nSee `if (x) {` above.", 1},
+		{"no finding", `[{"line_number": 3}]`, 0},
+		{"empty", "[]", 0},
+	} {
+		// Every split of the output yields the same findings
+		for size := 1; size <= len(test.output); size *= 4 {
+			var findings []LspDiagnostic
+			scanner := newFindingScanner(func(finding LspDiagnostic) { findings = append(findings, finding) })
+			for i := 0; i < len(test.output); i += size {
+				scanner.Write(test.output[i:min(i+size, len(test.output))])
+			}
+			if len(findings) != test.want {
+				t.Errorf("%s, %d bytes at a time: %d findings, want %d", test.name, size, len(findings), test.want)
+				continue
+			}
+			for _, f := range findings {
+				if f.Rule != "Rule 15.1" || f.Description != `use {x} " ok` {
+					t.Errorf("%s: finding %+v", test.name, f)
+				}
+			}
+		}
+	}
+}
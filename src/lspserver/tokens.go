@@ -0,0 +1,95 @@
+package lspserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// charsPerToken is how many characters a token covers at least, English averages four, code with
+// its operators and short identifiers less. Erring on the small side keeps requests in the window.
+const charsPerToken = 3
+
+// estimateTokens estimates the tokens text takes up without a tokenizer, rounding up
+func estimateTokens(text string) int {
+	return (len(text) + charsPerToken - 1) / charsPerToken
+}
+
+// defaultContextWindow is assumed for models neither configured nor known, small enough for all
+const defaultContextWindow = 4096
+
+// minChunkTokens keeps chunks useful when the prompt leaves little room in the context window
+const minChunkTokens = 256
+
+/*
+ * knownContextWindows are the context windows of common models in tokens, keyed by model name
+ * prefix, e.g. "deepseek-coder" also covers "deepseek-coder:6.7b". Settings.ContextWindows
+ * adds to and overrides them.
+ */
+var knownContextWindows = map[string]int{
+	"gpt-4o":             128000,
+	"gpt-4-turbo":        128000,
+	"gpt-4-1106-preview": 128000,
+	"gpt-4-0125-preview": 128000,
+	"gpt-4":              8192,
+	"gpt-3.5-turbo":      16385,
+	"deepseek-coder":     16384,
+	"codellama":          16384,
+	"llama3":             8192,
+	"qwen2.5-coder":      32768,
+}
+
+/*
+ * contextWindow returns the context window of a model in tokens. The longest configured or known
+ * prefix of the model name wins, configured windows take precedence over known ones of the same
+ * prefix.
+ *
+ * @param model The model name as sent to the backend
+ * @return tokens The context window, defaultContextWindow for unknown models
+ */
+func (s Settings) contextWindow(model string) int {
+	window, length := defaultContextWindow, -1
+	for _, windows := range []map[string]int{knownContextWindows, s.ContextWindows} {
+		for prefix, tokens := range windows {
+			if tokens > 0 && strings.HasPrefix(model, prefix) && len(prefix) >= length {
+				window, length = tokens, len(prefix)
+			}
+		}
+	}
+	return window
+}
+
+// maxOutputShare caps the tokens reserved for the answer at this share of the context window, the
+// max tokens of a backend are a limit and rarely needed for the findings of a chunk
+const maxOutputShare = 4
+
+// chunkOverheadTokens covers the query around a chunk, see chunkQuery, and the chat message framing
+const chunkOverheadTokens = 64
+
+/*
+ * chunkTokenBudget returns the tokens left for the source code of a chunk once the system prompt,
+ * the query around the chunk and the expected answer are taken out of the context window.
+ *
+ * @param window The context window of the model
+ * @param prompt The largest system prompt sent with a chunk
+ * @param req The analysis, its retry prompt is sent with every chunk
+ * @param output The max tokens of the backend, at most a maxOutputShare of the window is reserved
+ * @return tokens The budget of a chunk, at least minChunkTokens
+ */
+func chunkTokenBudget(window int, prompt string, req *AnalysisRequest, output int) int {
+	output = min(output, window/maxOutputShare)
+	budget := window - estimateTokens(prompt) - estimateTokens(req.RetryPrompt) -
+		estimateTokens(req.URI) - chunkOverheadTokens - output
+	if budget < minChunkTokens {
+		logs.Printf("Context window of %d tokens leaves %d tokens per chunk, sending %d anyway",
+			window, budget, minChunkTokens)
+		return minChunkTokens
+	}
+	return budget
+}
+
+// numberedLine is how chunks send a line, see chunkDocument
+func numberedLine(i int, line string) string {
+	return fmt.Sprintf("Line %d: %s\n", i+1, line)
+}
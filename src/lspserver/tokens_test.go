@@ -0,0 +1,77 @@
+package lspserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestContextWindow(t *testing.T) {
+	settings := Settings{ContextWindows: map[string]int{"deepseek-coder:33b": 65536, "gpt-4o": 64000, "mine": 2048}}
+	for model, want := range map[string]int{
+		"deepseek-coder:6.7b": 16384,
+		"deepseek-coder:33b":  65536,
+		"gpt-4o-mini":         64000,
+		"gpt-4-turbo":         128000,
+		"gpt-4":               8192,
+		"mine-7b":             2048,
+		"unknown":             defaultContextWindow,
+	} {
+		if got := settings.contextWindow(model); got != want {
+			t.Errorf("%s: %d, want %d", model, got, want)
+		}
+	}
+
+	merged := settings.Merge(Settings{ContextWindows: map[string]int{"mine": 8192}})
+	if merged.contextWindow("mine") != 8192 || merged.contextWindow("gpt-4o") != 64000 {
+		t.Errorf("merged windows %v", merged.ContextWindows)
+	}
+}
+
+func TestChunkDocumentTokens(t *testing.T) {
+	var lines []string
+	for f := 0; f < 4; f++ {
+		lines = append(lines, fmt.Sprintf("int f%d(int x)", f), "{")
+		for s := 0; s < 8; s++ {
+			lines = append(lines, fmt.Sprintf("    x = x * %d + %d;", s, f))
+		}
+		lines = append(lines, "    return x;", "}")
+	}
+	function := 0
+	for _, line := range lines[:12] {
+		function += estimateTokens(numberedLine(0, line))
+	}
+
+	// Two functions fit, the chunks end after them
+	chunks := ChunkDocument(lines, 2*function+function/2)
+	if len(chunks) != 2 || chunks[0].End != 23 || chunks[1].End != len(lines)-1 {
+		t.Errorf("chunks %v, want two functions each", chunks)
+	}
+
+	// Long lines take more of the budget than short ones
+	long := append([]string{}, lines...)
+	long[3] = "    x = x * 0 + 0; /* " + strings.Repeat("long comment ", 20) + "*/"
+	if chunks := ChunkDocument(long, 2*function+function/2); chunks[0].End != 11 {
+		t.Errorf("chunks %v, want the long function alone", chunks)
+	}
+
+	// A budget below a single line still makes progress
+	if chunks := ChunkDocument(lines, 1); len(chunks) != len(lines) {
+		t.Errorf("%d chunks, want one per line", len(chunks))
+	}
+}
+
+func TestChunkTokenBudget(t *testing.T) {
+	req := &AnalysisRequest{URI: "file:///a.c"}
+	prompt := strings.Repeat("x", 3000)
+	if got := chunkTokenBudget(16384, prompt, req, 4096); got != 16384-1000-4-chunkOverheadTokens-4096 {
+		t.Errorf("budget %d", got)
+	}
+	// At most a quarter of the window is kept for the answer
+	if got := chunkTokenBudget(4096, prompt, req, 4096); got != 4096-1000-4-chunkOverheadTokens-1024 {
+		t.Errorf("small window budget %d", got)
+	}
+	if got := chunkTokenBudget(1024, prompt, req, 4096); got != minChunkTokens {
+		t.Errorf("exhausted window budget %d", got)
+	}
+}
@@ -0,0 +1,378 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// defaultInclude lists the file patterns analysed in the background when the client sets none
+var defaultInclude = []string{"*.c", "*.h"}
+
+// defaultWorkspaceMaxFiles caps the files analysed in the background unless configured otherwise
+const defaultWorkspaceMaxFiles = 100
+
+// maxWorkspaceFileSize skips larger files in the background, they are analysed once opened
+const maxWorkspaceFileSize = 256 * 1024
+
+/*
+ * OnInitialize records the workspace folders sent by the client and answers with the
+ * capabilities derived from the server options.
+ *
+ * @param ctx The context of the request.
+ * @param req The initialize params.
+ * @return result The server capabilities
+ * @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnInitialize(ctx context.Context, req *defines.InitializeParams) (*defines.InitializeResult, *defines.InitializeError) {
+	folders := workspaceFolderPaths(req)
+	logs.Printf("OnInitialize: workspace folders %v", folders)
+
+	session := l.session(ctx)
+	if session == nil {
+		return nil, &defines.InitializeError{Retry: false}
+	}
+	session.mutex.Lock()
+	session.workspaceFolders = folders
+	session.hoverKind = hoverKind(req)
+	session.capabilities = capabilitiesOf(req)
+	session.mutex.Unlock()
+
+	result, err := l.server.DefaultInitialize(ctx, req)
+	if err != nil {
+		logs.Printf("Error initializing: %v", err)
+		return nil, &defines.InitializeError{Retry: false}
+	}
+	return &result, nil
+}
+
+// workspaceFolderPaths returns the local paths of the workspace folders, falling back to the
+// deprecated rootUri for older clients.
+func workspaceFolderPaths(req *defines.InitializeParams) []string {
+	var uris []string
+
+	var folders []defines.WorkspaceFolder
+	if data, err := json.Marshal(req.WorkspaceFolders); err == nil {
+		json.Unmarshal(data, &folders)
+	}
+	for _, folder := range folders {
+		uris = append(uris, folder.Uri)
+	}
+	if rootUri, ok := req.RootUri.(string); ok && len(uris) == 0 && rootUri != "" {
+		uris = append(uris, rootUri)
+	}
+
+	var paths []string
+	for _, uri := range uris {
+		p, err := ConvertFileURIToPath(uri)
+		if err != nil {
+			logs.Printf("Ignoring workspace folder %s: %v", uri, err)
+			continue
+		}
+		// Files below the folders may be read and sent to the backend, see readDocument
+		if p = filepath.Clean(p); filepath.Dir(p) == p {
+			logs.Printf("Ignoring workspace folder %s: the file system root", uri)
+			continue
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// hoverKind returns the first hover format supported by both sides, Markdown when the client has no preference
+func hoverKind(req *defines.InitializeParams) defines.MarkupKind {
+	caps := req.Capabilities.TextDocument
+	if caps == nil || caps.Hover == nil || caps.Hover.ContentFormat == nil {
+		return defines.MarkupKindMarkdown
+	}
+	for _, kind := range *caps.Hover.ContentFormat {
+		if kind == defines.MarkupKindMarkdown || kind == defines.MarkupKindPlainText {
+			return kind
+		}
+	}
+	return defines.MarkupKindMarkdown
+}
+
+// capabilitiesOf returns the server initiated requests the client supports, absent means unsupported
+func capabilitiesOf(req *defines.InitializeParams) clientCapabilities {
+	isSet := func(b *bool) bool { return b != nil && *b }
+
+	var caps clientCapabilities
+	if window := req.Capabilities.WindowCapabilities(); window != nil {
+		caps.workDoneProgress = isSet(window.WorkDoneProgress)
+	}
+	if workspace := req.Capabilities.WorkspaceCapabilities(); workspace != nil {
+		caps.diagnosticRefresh = workspace.Diagnostics != nil && isSet(workspace.Diagnostics.RefreshSupport)
+		caps.codeLensRefresh = workspace.CodeLens != nil && isSet(workspace.CodeLens.RefreshSupport)
+	}
+	return caps
+}
+
+/*
+ * workspaceFiles enumerates the files below the workspace folders whose name matches one of the
+ * include patterns. Hidden directories and node_modules are skipped.
+ *
+ * @param folders The workspace folder paths.
+ * @param include The file name patterns, see path/filepath.Match.
+ * @return uris The file URIs in walk order
+ */
+func workspaceFiles(folders []string, include []string) []string {
+	var uris []string
+	for _, folder := range folders {
+		filepath.WalkDir(folder, func(p string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				logs.Printf("Error walking %s: %v", p, err)
+				return nil
+			}
+			name := entry.Name()
+			if entry.IsDir() {
+				if p != folder && (strings.HasPrefix(name, ".") || name == "node_modules") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			for _, pattern := range include {
+				if ok, _ := filepath.Match(pattern, name); ok {
+					uris = append(uris, PathToFileURI(p))
+					break
+				}
+			}
+			return nil
+		})
+	}
+	return uris
+}
+
+// PathToFileURI is the inverse of ConvertFileURIToPath
+func PathToFileURI(p string) string {
+	p = filepath.ToSlash(p)
+	if !strings.HasPrefix(p, "/") {
+		// Windows drive letter paths
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
+
+/*
+ * startWorkspaceAnalysis (re)starts the background analysis of the workspace of the client behind
+ * ctx when the settings enable it. A running analysis is cancelled first, it worked with the
+ * previous settings.
+ *
+ * @param ctx The context of any request of the client, the analysis outlives it.
+ */
+func (l *lspServer) startWorkspaceAnalysis(ctx context.Context) {
+	session := l.session(ctx)
+	if session == nil {
+		return
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.stopWorkspace != nil {
+		session.stopWorkspace()
+		session.stopWorkspace = nil
+	}
+	if !l.getSettings().workspaceAnalysis() || session.isClosed() {
+		return
+	}
+
+	ctx, session.stopWorkspace = context.WithCancel(session.context())
+	go l.analyseWorkspaceInBackground(ctx)
+}
+
+/*
+ * analyseWorkspaceInBackground analyses the workspace files that are neither open nor analysed
+ * yet, at most Settings.workspaceMaxFiles of them. Files are handled one at a time and only while
+ * no other analysis is running, so documents the user is working on always take precedence. The
+ * results go to the workspace store of the session, see documentStore.
+ *
+ * @param ctx The context of the analysis, cancelled by startWorkspaceAnalysis.
+ */
+func (l *lspServer) analyseWorkspaceInBackground(ctx context.Context) {
+	session := l.session(ctx)
+	if session == nil {
+		return
+	}
+	settings := l.getSettings()
+	uris := workspaceFiles(session.getWorkspaceFolders(), settings.Include)
+	if len(uris) == 0 {
+		return
+	}
+	if limit := settings.workspaceMaxFiles(); len(uris) > limit {
+		logs.Printf("[+] Workspace has %d files, analysing the first %d in the background", len(uris), limit)
+		uris = uris[:limit]
+	}
+	logs.Printf("[+] Background analysis of %d workspace files", len(uris))
+
+	progress := l.beginProgress(ctx, nil, "Analysing workspace")
+	analysed := 0
+	for i, uri := range uris {
+		if err := l.running.waitForIdle(ctx); err != nil || session.isClosed() || ctx.Err() != nil {
+			break
+		}
+		progress.Report(i, len(uris), path.Base(uri))
+
+		if _, err := session.documents.Load(uri); err == nil {
+			// Open, the foreground analysis owns this document
+			continue
+		}
+		if _, err := session.workspace.GetDiagnostics(uri); err == nil {
+			continue
+		}
+		text, err := l.readDocument(ctx, uri)
+		if err != nil || text == "" {
+			continue
+		}
+		if len(text) > maxWorkspaceFileSize {
+			logs.Printf("Skipping %s in the background, %d bytes", uri, len(text))
+			continue
+		}
+		session.workspace.Store(uri, text)
+
+		// The workspace progress covers the per file analysis
+		if err = l.analyseDocument(withoutProgress(ctx), uri, text); err != nil {
+			logs.Printf("Background analysis of %s failed: %v", uri, err)
+			continue
+		}
+		analysed += 1
+		l.refreshDiagnostics(ctx)
+	}
+	progress.End(fmt.Sprintf("%d files analysed", analysed))
+}
+
+// analysisCounter counts the analyses in flight, the background workspace analysis waits for
+// it to drop to zero
+type analysisCounter struct {
+	mutex   sync.Mutex
+	running int
+	// Closed once running drops to zero, only made while someone waits
+	idle chan struct{}
+}
+
+func (c *analysisCounter) add(delta int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.running += delta
+	if c.running == 0 && c.idle != nil {
+		close(c.idle)
+		c.idle = nil
+	}
+}
+
+// waitForIdle blocks until no analysis is running, or until ctx is done and returns its error
+func (c *analysisCounter) waitForIdle(ctx context.Context) error {
+	c.mutex.Lock()
+	if c.running == 0 {
+		c.mutex.Unlock()
+		return nil
+	}
+	if c.idle == nil {
+		c.idle = make(chan struct{})
+	}
+	idle := c.idle
+	c.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+ * readDocument reads a document from disk. Clients may name any URI, so only files below the
+ * workspace folders of the client behind ctx are read, their content is sent to the backend.
+ *
+ * @param ctx The context of the request.
+ * @param uri The file URI.
+ * @return text The file content
+ * @return error Any error that occurred while reading, also for files outside the workspace
+ */
+func (l *lspServer) readDocument(ctx context.Context, uri string) (string, error) {
+	filePath, err := ConvertFileURIToPath(uri)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(uri, "file:") || !l.session(ctx).inWorkspace(filePath) {
+		return "", fmt.Errorf("%s is not a file in the workspace folders", uri)
+	}
+	return ReadFileContent(filePath)
+}
+
+/*
+ * OnWorkspaceDiagnostic is called when the client pulls the diagnostics of the whole workspace,
+ * it returns a report for every document analysed so far. Documents whose previousResultId is
+ * still current get an unchanged report.
+ *
+ * @param ctx The context of the request.
+ * @param req The workspace diagnostic params from the client.
+ * @return report The workspace diagnostic report
+ * @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnWorkspaceDiagnostic(ctx context.Context, req *defines.WorkspaceDiagnosticParams) (*defines.WorkspaceDiagnosticReport, error) {
+	logs.Printf("OnWorkspaceDiagnostic called")
+
+	previous := make(map[string]string, len(req.PreviousResultIds))
+	for _, p := range req.PreviousResultIds {
+		previous[string(p.Uri)] = p.Value
+	}
+
+	// Open documents first, files analysed in the background only while they are not open
+	session := l.session(ctx)
+	if session == nil {
+		return nil, errSessionClosed
+	}
+	open := session.documents.Dump()
+	uris := make([]string, 0, len(open))
+	for uri := range open {
+		uris = append(uris, uri)
+	}
+	for uri := range session.workspace.Dump() {
+		if _, ok := open[uri]; !ok {
+			uris = append(uris, uri)
+		}
+	}
+
+	report := defines.WorkspaceDiagnosticReport{Items: []defines.WorkspaceDocumentDiagnosticReport{}}
+	for _, uri := range uris {
+		resultId := l.documentStore(ctx, uri).ResultId(uri)
+		if resultId != "" && previous[uri] == resultId {
+			report.Items = append(report.Items, defines.WorkspaceUnchangedDocumentDiagnosticReport{
+				UnchangedDocumentDiagnosticReport: defines.UnchangedDocumentDiagnosticReport{
+					Kind:     defines.DocumentDiagnosticReportKindUnChanged,
+					ResultId: resultId,
+				},
+				Uri: defines.DocumentUri(uri),
+			})
+			continue
+		}
+
+		items, err := l.diagnosticItems(ctx, uri)
+		if err != nil {
+			continue
+		}
+		full := defines.FullDocumentDiagnosticReport{
+			Kind:  defines.DocumentDiagnosticReportKindFull,
+			Items: items,
+		}
+		if resultId != "" {
+			full.ResultId = &resultId
+		}
+		report.Items = append(report.Items, defines.WorkspaceFullDocumentDiagnosticReport{
+			FullDocumentDiagnosticReport: full,
+			Uri:                          defines.DocumentUri(uri),
+		})
+	}
+
+	logs.Printf("Workspace diagnostics report created for %d documents", len(report.Items))
+	return &report, nil
+}
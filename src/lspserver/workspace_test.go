@@ -0,0 +1,141 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+func TestCapabilitiesOf(t *testing.T) {
+	for _, test := range []struct {
+		capabilities string
+		want         clientCapabilities
+	}{
+		{`{}`, clientCapabilities{}},
+		{`{"window": {"workDoneProgress": true}, "workspace": {"workspaceFolders": true, "configuration": true,
+			"diagnostics": {"refreshSupport": true}, "codeLens": {"refreshSupport": false}}}`,
+			clientCapabilities{workDoneProgress: true, diagnosticRefresh: true}},
+		{`{"workspace": {"codeLens": {"refreshSupport": true}}}`, clientCapabilities{codeLensRefresh: true}},
+	} {
+		var req defines.InitializeParams
+		if err := json.Unmarshal([]byte(`{"capabilities": `+test.capabilities+`}`), &req); err != nil {
+			t.Fatal(err)
+		}
+		if got := capabilitiesOf(&req); got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.capabilities, got, test.want)
+		}
+	}
+}
+
+func TestAnalysisCounterWaitForIdle(t *testing.T) {
+	var counter analysisCounter
+	ctx := context.Background()
+	// Idle from the start
+	if err := counter.waitForIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	counter.add(1)
+	counter.add(1)
+	idle := make(chan error)
+	go func() {
+		idle <- counter.waitForIdle(ctx)
+	}()
+
+	counter.add(-1)
+	select {
+	case <-idle:
+		t.Fatal("idle with an analysis running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	counter.add(-1)
+	select {
+	case err := <-idle:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still waiting once no analysis runs")
+	}
+
+	// Cancelled waits end although analyses keep running
+	counter.add(1)
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		idle <- counter.waitForIdle(cancelled)
+	}()
+	cancel()
+	select {
+	case err := <-idle:
+		if err != context.Canceled {
+			t.Errorf("cancelled wait: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after cancellation")
+	}
+}
+
+func TestWorkspaceAnalysisSettings(t *testing.T) {
+	on, off := true, false
+	settings := Settings{}
+	if settings.workspaceAnalysis() || settings.workspaceMaxFiles() != defaultWorkspaceMaxFiles {
+		t.Errorf("defaults %+v", settings)
+	}
+	settings = settings.Merge(Settings{WorkspaceAnalysis: &on, WorkspaceMaxFiles: 5})
+	if !settings.workspaceAnalysis() || settings.workspaceMaxFiles() != 5 {
+		t.Errorf("enabled %+v", settings)
+	}
+	// Clients can turn it off again
+	if settings.Merge(Settings{WorkspaceAnalysis: &off}).workspaceAnalysis() {
+		t.Errorf("still enabled")
+	}
+}
+
+func TestReadDocumentOnlyInWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "work")
+	secret := filepath.Join(dir, "secret.c")
+	for file, text := range map[string]string{filepath.Join(folder, "main.c"): "int x;\n", secret: "int key;\n"} {
+		os.MkdirAll(filepath.Dir(file), 0o755)
+		if err := os.WriteFile(file, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(secret, filepath.Join(folder, "link.c")); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &lspServer{sessions: make(map[int]*clientSession)}
+	ctx := context.Background()
+	l.session(ctx).workspaceFolders = []string{folder}
+
+	if text, err := l.readDocument(ctx, PathToFileURI(filepath.Join(folder, "main.c"))); err != nil || text != "int x;\n" {
+		t.Errorf("workspace file: %q, %v", text, err)
+	}
+	for _, uri := range []string{
+		PathToFileURI(secret),
+		"file://" + folder + "/../secret.c",
+		PathToFileURI(filepath.Join(folder, "link.c")),
+		"http://example.com" + folder + "/main.c",
+	} {
+		if text, err := l.readDocument(ctx, uri); err == nil {
+			t.Errorf("%s was read: %q", uri, text)
+		}
+	}
+}
+
+func TestWorkspaceFolderPathsSkipsRoot(t *testing.T) {
+	var req defines.InitializeParams
+	if err := json.Unmarshal([]byte(`{"workspaceFolders": [{"uri": "file:///", "name": "root"},
+		{"uri": "file:///work", "name": "work"}]}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if got := workspaceFolderPaths(&req); len(got) != 1 || got[0] != "/work" {
+		t.Errorf("folders %v, want [/work]", got)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"encoding/json"
 	"io"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
 var AppName = "lsp-server"
@@ -17,11 +19,24 @@ var version = "unknown"
 
 type Config struct {
     Stdio       bool   `json:"stdio"`
+	Listen      string                     `json:"listen"`
     Version     bool   `json:"version"`
     PromptFile  string `json:"prompt_file"`
     Backend     string `json:"backend"`
     ConnectTest bool   `json:"connect_test"`
 	RetryPrompt string `json:"retry_prompt"`
+	RuleCatalog string                     `json:"rule_catalog"`
+	RuleDocs    map[string]string          `json:"rule_docs"`
+	Backends    map[string]json.RawMessage `json:"backends"`
+	// Unset means enabled
+	StructuredOutput *bool `json:"structured_output"`
+	// Unset means disabled
+	WorkspaceAnalysis bool `json:"workspace_analysis"`
+	WorkspaceMaxFiles int  `json:"workspace_max_files"`
+	// Context window in tokens keyed by model name prefix
+	ContextWindows map[string]int `json:"context_windows"`
+	// Backend, model, prompt and rules by languageId or file glob
+	Routes []lspserver.Route `json:"routes"`
 }
 
 func readConfigFile(filePath string) (*Config, error) {
@@ -71,24 +86,48 @@ func init() {
     }
 
     _ = flag.Bool("stdio", config.Stdio, "Use stdio for LSP communication")
+	lspserver.ParamListen = flag.String("listen", config.Listen, "serve clients on tcp:host:port, tcp:port (loopback only) or unix:path instead of stdio, all clients share the backend and analysis cache")
     checkVersion = flag.Bool("version", config.Version, "Print version and exit")
     lspserver.ParamPromptFile = flag.String("prompt-file", config.PromptFile, "prompt file path")
-    lspserver.ParamBackend = flag.String("backend", config.Backend, "backend to use (openai)")
+	lspserver.ParamBackend = flag.String("backend", config.Backend, "backend to use, \"list\" prints the available backends")
     lspserver.ParamConnectTest = flag.Bool("connect-test", config.ConnectTest, "test connection to backend")
 	lspserver.ParamRetryPromptFile = flag.String("retry-prompt", config.RetryPrompt, "Retry Prompt File")
+	lspserver.ParamRuleCatalog = flag.String("rule-catalog", config.RuleCatalog, "rule catalog file shown in hovers")
+	lspserver.ParamStructuredOutput = flag.Bool("structured-output", config.StructuredOutput == nil || *config.StructuredOutput,
+		"constrain the backend output to the findings schema where the backend supports it")
+	lspserver.ParamWorkspaceAnalysis = flag.Bool("workspace-analysis", config.WorkspaceAnalysis,
+		"analyse the workspace files in the background, clients may turn it on or off")
+	lspserver.ParamWorkspaceMaxFiles = flag.Int("workspace-max-files", config.WorkspaceMaxFiles,
+		"analyse at most this many workspace files in the background, 0 for the default")
+	lspserver.ParamRuleDocs = config.RuleDocs
+	lspserver.ParamBackends = config.Backends
+	lspserver.ParamContextWindows = config.ContextWindows
+	lspserver.ParamRoutes = config.Routes
 	
 	flag.Parse()
 
-	if *lspserver.ParamBackend != "ollama" && *lspserver.ParamBackend != "openai" {
-		fmt.Println("valid backends: ollama, openai")
-		os.Exit(1)
+	if *lspserver.ParamBackend == "list" {
+		fmt.Print(lspserver.BackendList())
+		os.Exit(0)
 	}
-
 	if *checkVersion {
 		fmt.Printf("%s (build %s)\n", AppName, version)
 		os.Exit(0)
 	}
 
+	// stdio unless a socket is given
+	if *lspserver.ParamListen != "" {
+		if _, _, err := lspserver.ParseListenAddress(*lspserver.ParamListen); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if !slices.Contains(lspserver.BackendNames(), *lspserver.ParamBackend) {
+		fmt.Printf("valid backends: %s\n", strings.Join(lspserver.BackendNames(), ", "))
+		os.Exit(1)
+	}
+
 	logPath = flag.String("logs", "", "logs file path")
 	if logPath == nil || *logPath == "" {
 		logger = log.New(os.Stderr, "", 0)
@@ -113,5 +152,8 @@ func init() {
 
 func main() {
 	logs.Printf("%s (build %s)\n", AppName, version)
-	lspserver.Serve(AppName)
+	if err := lspserver.Serve(AppName); err != nil {
+		logs.Printf("%v", err)
+		os.Exit(1)
+	}
 }